@@ -0,0 +1,62 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type cacheEntry[V any] struct {
+	key     string
+	value   V
+	expires time.Time
+}
+
+// lruCache holds values for the duration of a window, the least recently added values are evicted when it is full
+type lruCache[V any] struct {
+	mu      sync.Mutex
+	window  time.Duration
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+func newLRUCache[V any](window time.Duration, size int) *lruCache[V] {
+	return &lruCache[V]{window: window, size: size, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// get returns the value of a key added within the window
+func (c *lruCache[V]) get(key string, now time.Time) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var value V
+	e, ok := c.entries[key]
+	if !ok {
+		return value, false
+	}
+	entry := e.Value.(*cacheEntry[V])
+	if now.After(entry.expires) {
+		c.order.Remove(e)
+		delete(c.entries, key)
+		return value, false
+	}
+	return entry.value, true
+}
+
+// add adds or refreshes the value of a key
+func (c *lruCache[V]) add(key string, value V, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*cacheEntry[V])
+		entry.value, entry.expires = value, now.Add(c.window)
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry[V]{key: key, value: value, expires: now.Add(c.window)})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry[V]).key)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	conntrack "github.com/florianl/go-conntrack"
+	"golang.org/x/sys/unix"
+)
+
+// cascades of a delete action, related also includes the expectations
+const (
+	cascadeExpectations = "expectations"
+	cascadeRelated      = "related"
+)
+
+// cascade deletes the expectations created by a deleted entry and optionally its related child connections
+type cascade struct {
+	related bool
+}
+
+// buildCascade returns the cascade of an action or nil if only the entry itself is deleted
+func (ac *actionConfig) buildCascade(v *validator, path []any) *cascade {
+	switch ac.Cascade {
+	case "":
+		return nil
+	case cascadeExpectations, cascadeRelated:
+		if ac.Type != actionDelete {
+			v.errorf(field(path, "cascade"), "only delete actions have a cascade")
+		}
+		return &cascade{related: ac.Cascade == cascadeRelated}
+	}
+	v.errorf(field(path, "cascade"), "unknown cascade %q", ac.Cascade)
+	return nil
+}
+
+// sameTuple reports whether two tuples have the same addresses, protocol and ports
+func sameTuple(a, b *conntrack.IPTuple) bool {
+	if a == nil || b == nil || a.Src == nil || a.Dst == nil || b.Src == nil || b.Dst == nil ||
+		!a.Src.Equal(*b.Src) || !a.Dst.Equal(*b.Dst) {
+		return false
+	}
+	pa, pb := a.Proto, b.Proto
+	if pa == nil || pb == nil {
+		return pa == pb
+	}
+	for _, v := range [][2]*uint8{{pa.Number, pb.Number}, {pa.IcmpType, pb.IcmpType}, {pa.Icmpv6Type, pb.Icmpv6Type}} {
+		if (v[0] == nil) != (v[1] == nil) || v[0] != nil && *v[0] != *v[1] {
+			return false
+		}
+	}
+	for _, v := range [][2]*uint16{{pa.SrcPort, pb.SrcPort}, {pa.DstPort, pb.DstPort}, {pa.IcmpID, pb.IcmpID}, {pa.Icmpv6ID, pb.Icmpv6ID}} {
+		if (v[0] == nil) != (v[1] == nil) || v[0] != nil && *v[0] != *v[1] {
+			return false
+		}
+	}
+	return true
+}
+
+// sameZone reports whether two entries are in the same zone, entries in the default zone carry no zone attribute
+func sameZone(a, b *uint16) bool {
+	var za, zb uint16
+	if a != nil {
+		za = *a
+	}
+	if b != nil {
+		zb = *b
+	}
+	return za == zb
+}
+
+// cascadeCounts are the numbers of expectations and related entries deleted with an entry and of the protected
+// related entries which were left alone
+type cascadeCounts struct {
+	expected, related, protected int
+}
+
+// cascadeDelete deletes the expectations and related connections of the first existing candidate of a deletion,
+// before the entry itself as the kernel silently drops the expectations together with their master
+func (l *listener) cascadeDelete(del *deletion) (cascadeCounts, error) {
+	var counts cascadeCounts
+	var master conntrack.Con
+	var candidate conntrack.Con
+	var err error
+	for _, candidate = range del.cons {
+		if master, err = getConntrack(l.nfct, l.logger, del.family, candidate); !errors.Is(err, unix.ENOENT) {
+			break
+		}
+	}
+	if errors.Is(err, unix.ENOENT) {
+		return counts, nil
+	}
+	if err != nil {
+		return counts, fmt.Errorf("could not get CT entry: %v", err)
+	}
+	if master.Origin == nil {
+		return counts, fmt.Errorf("CT entry without original tuple")
+	}
+	// the kernel ignores the ID when getting an entry, a newer connection which reused the tuple is left alone
+	if candidate.ID != nil && (master.ID == nil || *master.ID != *candidate.ID) {
+		return counts, nil
+	}
+	expectations, err := l.nfct.Dump(conntrack.Expected, del.family)
+	if err != nil {
+		return counts, fmt.Errorf("could not dump expectation table: %v", err)
+	}
+	for _, e := range expectations {
+		// the master tuple of an expectation is reported as the original tuple
+		if e.Exp == nil || e.Exp.Tuple == nil || !sameTuple(e.Origin, master.Origin) || !sameZone(e.Exp.Zone, master.Zone) {
+			continue
+		}
+		// an expectation deletion without tuple would flush the whole table, the tuple is always set here
+		exp := conntrack.Con{Exp: &conntrack.Exp{Tuple: e.Exp.Tuple, ID: e.Exp.ID, Zone: e.Exp.Zone}}
+		if err := l.nfct.Delete(conntrack.Expected, del.family, exp); err != nil {
+			if errors.Is(err, unix.ENOENT) {
+				continue
+			}
+			return counts, fmt.Errorf("could not delete expectation %s: %v", formatCon(conntrack.Con{Origin: e.Exp.Tuple}), err)
+		}
+		counts.expected++
+	}
+	if !del.cascade.related {
+		return counts, nil
+	}
+	children, err := relatedConntrack(l.nfct, del.family, master)
+	if err != nil {
+		return counts, err
+	}
+	for _, c := range children {
+		if l.protect != nil && l.protect(&packet{family: del.family, con: c}) {
+			l.logger.Printf("Not deleting protected related CT entry: %s", formatCon(c))
+			protectedCounter.WithLabelValues(del.labels...).Inc()
+			counts.protected++
+			continue
+		}
+		if l.debug {
+			l.logger.Printf("  Related: %s", formatCon(c))
+		}
+		if err := deleteConntrack(l.nfct, del.family, scopedDeletion(c)); err != nil {
+			if errors.Is(err, unix.ENOENT) {
+				continue
+			}
+			return counts, fmt.Errorf("could not delete related CT entry %s: %v", formatCon(c), err)
+		}
+		counts.related++
+	}
+	return counts, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	conntrack "github.com/florianl/go-conntrack"
+	"golang.org/x/sys/unix"
+)
+
+type conditionConfig struct {
+	MinAge   time.Duration `yaml:"min_age"`
+	Status   []string      `yaml:"status"`
+	TCPState []string      `yaml:"tcp_state"`
+	Helper   string        `yaml:"helper"`
+	MinBytes uint64        `yaml:"min_bytes"`
+}
+
+// condition checks the live conntrack entry before its deletion, it returns the name of the condition and the reason
+// if the entry does not meet it
+type condition func(entry conntrack.Con, now time.Time) (string, string)
+
+// statusBits are the conntrack status bits from linux/netfilter/nf_conntrack_common.h
+var statusBits = map[string]uint32{
+	"expected":   1 << 0,
+	"seen_reply": 1 << 1,
+	"assured":    1 << 2,
+	"confirmed":  1 << 3,
+	"src_nat":    1 << 4,
+	"dst_nat":    1 << 5,
+	"offload":    1 << 14,
+}
+
+// tcpStates are the conntrack TCP states from linux/netfilter/nf_conntrack_tcp.h
+var tcpStates = map[string]uint8{
+	"none":        0,
+	"syn_sent":    1,
+	"syn_recv":    2,
+	"established": 3,
+	"fin_wait":    4,
+	"close_wait":  5,
+	"last_ack":    6,
+	"time_wait":   7,
+	"close":       8,
+	"syn_sent2":   9,
+}
+
+// build returns the conditions of a rule, all of them have to be met
+func (cc *conditionConfig) build(v *validator, path []any) []condition {
+	if cc == nil {
+		return nil
+	}
+	var conditions []condition
+	if cc.MinAge < 0 {
+		v.errorf(field(path, "min_age"), "negative age")
+	} else if cc.MinAge > 0 {
+		conditions = append(conditions, conditionMinAge(cc.MinAge))
+	}
+	for i, name := range cc.Status {
+		bit, ok := statusBits[name]
+		switch {
+		case name == "unreplied":
+			conditions = append(conditions, conditionStatus(name, statusBits["seen_reply"], false))
+		case !ok:
+			v.errorf(field(path, "status", i), "unknown status %q", name)
+		default:
+			conditions = append(conditions, conditionStatus(name, bit, true))
+		}
+	}
+	if len(cc.TCPState) > 0 {
+		var states []uint8
+		for i, name := range cc.TCPState {
+			state, ok := tcpStates[name]
+			if !ok {
+				v.errorf(field(path, "tcp_state", i), "unknown TCP state %q", name)
+				continue
+			}
+			states = append(states, state)
+		}
+		conditions = append(conditions, conditionTCPState(states))
+	}
+	if cc.Helper != "" {
+		conditions = append(conditions, conditionHelper(cc.Helper))
+	}
+	if cc.MinBytes > 0 {
+		conditions = append(conditions, conditionMinBytes(cc.MinBytes))
+	}
+	return conditions
+}
+
+func conditionMinAge(minAge time.Duration) condition {
+	return func(entry conntrack.Con, now time.Time) (string, string) {
+		if entry.Timestamp == nil || entry.Timestamp.Start == nil {
+			return "min_age", "no start timestamp, conntrack timestamps are disabled"
+		}
+		if age := now.Sub(*entry.Timestamp.Start); age < minAge {
+			return "min_age", fmt.Sprintf("age %s below %s", age.Truncate(time.Second), minAge)
+		}
+		return "", ""
+	}
+}
+
+func conditionStatus(name string, bit uint32, set bool) condition {
+	return func(entry conntrack.Con, _ time.Time) (string, string) {
+		if entry.Status == nil || (*entry.Status&bit != 0) != set {
+			return "status", "status not " + name
+		}
+		return "", ""
+	}
+}
+
+func conditionTCPState(states []uint8) condition {
+	return func(entry conntrack.Con, _ time.Time) (string, string) {
+		if entry.ProtoInfo == nil || entry.ProtoInfo.TCP == nil || entry.ProtoInfo.TCP.State == nil {
+			return "tcp_state", "no TCP state"
+		}
+		if !slices.Contains(states, *entry.ProtoInfo.TCP.State) {
+			return "tcp_state", fmt.Sprintf("TCP state %s", tcpStateName(*entry.ProtoInfo.TCP.State))
+		}
+		return "", ""
+	}
+}
+
+func conditionHelper(name string) condition {
+	return func(entry conntrack.Con, _ time.Time) (string, string) {
+		if entry.Helper == nil || entry.Helper.Name == nil || !strings.EqualFold(*entry.Helper.Name, name) {
+			return "helper", "helper not " + name
+		}
+		return "", ""
+	}
+}
+
+func conditionMinBytes(minBytes uint64) condition {
+	return func(entry conntrack.Con, _ time.Time) (string, string) {
+		var total uint64
+		for _, c := range []*conntrack.Counter{entry.CounterOrigin, entry.CounterReply} {
+			switch {
+			case c == nil:
+			case c.Bytes != nil:
+				total += *c.Bytes
+			case c.Bytes32 != nil:
+				total += uint64(*c.Bytes32)
+			}
+		}
+		if total < minBytes {
+			return "min_bytes", fmt.Sprintf("%d bytes below %d", total, minBytes)
+		}
+		return "", ""
+	}
+}
+
+func tcpStateName(state uint8) string {
+	for name, s := range tcpStates {
+		if s == state {
+			return name
+		}
+	}
+	return fmt.Sprintf("%d", state)
+}
+
+// checkConditions fetches the live conntrack entry of the first candidate found and checks the conditions of a rule,
+// it returns the name of the first condition not met and the reason
+func (l *listener) checkConditions(r *rule, family conntrack.Family, candidates []conntrack.Con) (string, string, error) {
+	var entry conntrack.Con
+	var err error
+	for _, con := range candidates {
+		if entry, err = getConntrack(l.nfct, l.logger, family, con); !errors.Is(err, unix.ENOENT) {
+			break
+		}
+	}
+	if errors.Is(err, unix.ENOENT) {
+		return "not_found", "entry not found", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	now := time.Now()
+	for _, c := range r.conditions {
+		if name, reason := c(entry, now); name != "" {
+			return name, reason, nil
+		}
+	}
+	return "", "", nil
+}
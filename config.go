@@ -0,0 +1,628 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	nflog "github.com/florianl/go-nflog/v2"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultDrainTimeout = 5 * time.Second
+
+type config struct {
+	Logging        loggingConfig            `yaml:"logging"`
+	Metrics        metricsConfig            `yaml:"metrics"`
+	DrainTimeout   time.Duration            `yaml:"drain_timeout"`
+	DryRun         bool                     `yaml:"dry_run"`
+	RateLimit      *rateLimitConfig         `yaml:"rate_limit"`
+	CircuitBreaker circuitBreakerConfig     `yaml:"circuit_breaker"`
+	Dedup          dedupConfig              `yaml:"dedup"`
+	Fragments      fragmentConfig           `yaml:"fragments"`
+	Retry          retryConfig              `yaml:"retry"`
+	DeadLetter     string                   `yaml:"dead_letter"`
+	Protect        protectConfig            `yaml:"protect"`
+	Actions        map[string]*actionConfig `yaml:"actions"`
+	Listeners      []*listenerConfig        `yaml:"listeners"`
+
+	root *yaml.Node
+}
+
+type loggingConfig struct {
+	Debug  bool   `yaml:"debug"`
+	Target string `yaml:"target"`
+}
+
+type metricsConfig struct {
+	Socket  string `yaml:"socket"`
+	Address string `yaml:"address"`
+}
+
+// protectConfig describes conntrack entries which are never deleted, whatever the matching rule says
+type protectConfig struct {
+	Networks []string `yaml:"networks"`
+	Ports    []string `yaml:"ports"`
+	Zones    []uint16 `yaml:"zones"`
+	Marks    []string `yaml:"marks"`
+	Filters  []string `yaml:"filters"`
+}
+
+type actionConfig struct {
+	Type    string         `yaml:"type"`
+	DryRun  bool           `yaml:"dry_run"`
+	Mark    string         `yaml:"mark"`
+	Timeout *time.Duration `yaml:"timeout"`
+	Status  []string       `yaml:"status"`
+
+	Scope          string `yaml:"scope"`
+	BothDirections bool   `yaml:"both_directions"`
+	AllZones       bool   `yaml:"all_zones"`
+	MaxEntries     int    `yaml:"max_entries"`
+
+	Cascade string `yaml:"cascade"`
+}
+
+type listenerConfig struct {
+	Name             string            `yaml:"name"`
+	Group            *uint16           `yaml:"group"`
+	NetNS            string            `yaml:"netns"`
+	CopyMode         string            `yaml:"copy_mode"`
+	CopyRange        uint32            `yaml:"copy_range"`
+	QThresh          uint32            `yaml:"qthresh"`
+	Timeout          uint32            `yaml:"timeout"`
+	ConntrackInfo    *bool             `yaml:"conntrack_info"`
+	Zone             *uint16           `yaml:"zone"`
+	InterfaceZones   map[string]uint16 `yaml:"interface_zones"`
+	TryZones         []uint16          `yaml:"try_zones"`
+	GenericProtocols []string          `yaml:"generic_protocols"`
+	Tunnels          *tunnelConfig     `yaml:"tunnels"`
+	DeleteByID       *bool             `yaml:"delete_by_id"`
+	Debug            bool              `yaml:"debug"`
+	Action           string            `yaml:"action"`
+	Rules            []*ruleConfig     `yaml:"rules"`
+}
+
+type ruleConfig struct {
+	Name       string           `yaml:"name"`
+	Match      matchConfig      `yaml:"match"`
+	Filter     string           `yaml:"filter"`
+	Action     string           `yaml:"action"`
+	RateLimit  *rateLimitConfig `yaml:"rate_limit"`
+	Dedup      *bool            `yaml:"dedup"`
+	Conditions *conditionConfig `yaml:"conditions"`
+}
+
+type matchConfig struct {
+	Family   string   `yaml:"family"`
+	Protocol []string `yaml:"protocol"`
+	Src      []string `yaml:"src"`
+	Dst      []string `yaml:"dst"`
+	SrcPort  []string `yaml:"sport"`
+	DstPort  []string `yaml:"dport"`
+	Mark     string   `yaml:"mark"`
+	CtMark   string   `yaml:"ctmark"`
+	Prefix   string   `yaml:"prefix"`
+	InIface  string   `yaml:"iif"`
+	OutIface string   `yaml:"oif"`
+}
+
+// configError describes an invalid field of the configuration file
+type configError struct {
+	line  int
+	field string
+	err   error
+}
+
+func (e *configError) Error() string {
+	if e.line > 0 {
+		return fmt.Sprintf("line %d: %s: %v", e.line, e.field, e.err)
+	}
+	return fmt.Sprintf("%s: %v", e.field, e.err)
+}
+
+// validator collects the errors found while building a configuration
+type validator struct {
+	root *yaml.Node
+	errs []error
+}
+
+func (v *validator) errorf(path []any, format string, args ...any) {
+	v.errs = append(v.errs, &configError{
+		line:  nodeLine(v.root, path),
+		field: fieldName(path),
+		err:   fmt.Errorf(format, args...),
+	})
+}
+
+func (v *validator) err() error {
+	return errors.Join(v.errs...)
+}
+
+// field returns a copy of path extended by elems
+func field(path []any, elems ...any) []any {
+	return append(append([]any{}, path...), elems...)
+}
+
+func fieldName(path []any) string {
+	var sb strings.Builder
+	for _, elem := range path {
+		switch e := elem.(type) {
+		case int:
+			fmt.Fprintf(&sb, "[%d]", e)
+		default:
+			if sb.Len() > 0 {
+				sb.WriteString(".")
+			}
+			fmt.Fprintf(&sb, "%v", e)
+		}
+	}
+	return sb.String()
+}
+
+// nodeLine returns the line of the YAML node referenced by path, or of its closest existing parent
+func nodeLine(root *yaml.Node, path []any) int {
+	if root == nil {
+		return 0
+	}
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	line := node.Line
+	for _, elem := range path {
+		var next *yaml.Node
+		switch e := elem.(type) {
+		case int:
+			if node.Kind == yaml.SequenceNode && e < len(node.Content) {
+				next = node.Content[e]
+			}
+		case string:
+			if node.Kind == yaml.MappingNode {
+				for i := 0; i+1 < len(node.Content); i += 2 {
+					if node.Content[i].Value == e {
+						next = node.Content[i+1]
+						break
+					}
+				}
+			}
+		}
+		if next == nil {
+			break
+		}
+		node = next
+		line = node.Line
+	}
+	return line
+}
+
+func loadConfig(path string) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(data)
+}
+
+func parseConfig(data []byte) (*config, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	cfg := &config{root: &root}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *config) drainTimeout() time.Duration {
+	if c.DrainTimeout == 0 {
+		return defaultDrainTimeout
+	}
+	return c.DrainTimeout
+}
+
+// buildActions validates the configured actions and merges them with the builtin ones
+func (c *config) buildActions(v *validator) map[string]*action {
+	actions := make(map[string]*action, len(builtinActions)+len(c.Actions))
+	for name, a := range builtinActions {
+		actions[name] = a
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.Actions)) {
+		ac := c.Actions[name]
+		path := []any{"actions", name}
+		if _, ok := builtinActions[name]; ok {
+			v.errorf(path, "action name %q is reserved", name)
+			continue
+		}
+		if ac == nil {
+			v.errorf(path, "missing action definition")
+			continue
+		}
+		a := &action{name: name, kind: ac.Type, dryRun: ac.DryRun}
+		switch ac.Type {
+		case actionDelete, actionLog, actionIgnore:
+			if ac.Mark != "" || ac.Timeout != nil || len(ac.Status) > 0 {
+				v.errorf(path, "only update actions change the mark, timeout or status")
+			}
+		case actionUpdate:
+			a.update = ac.buildUpdate(v, path)
+		case "":
+			v.errorf(field(path, "type"), "missing action type")
+			continue
+		default:
+			v.errorf(field(path, "type"), "unknown action type %q", ac.Type)
+			continue
+		}
+		a.scope = ac.buildScope(v, path)
+		if a.scope != nil && !a.modifies() {
+			v.errorf(field(path, "scope"), "only delete and update actions have a scope")
+		}
+		a.cascade = ac.buildCascade(v, path)
+		actions[name] = a
+	}
+	return actions
+}
+
+// build validates the configuration and returns the listeners described by it
+func (c *config) build() ([]*listener, error) {
+	v := &validator{root: c.root}
+	switch c.Logging.Target {
+	case "", "syslog", "stdout", "stderr":
+	default:
+		v.errorf([]any{"logging", "target"}, "unknown logging target %q", c.Logging.Target)
+	}
+	if c.DrainTimeout < 0 {
+		v.errorf([]any{"drain_timeout"}, "negative drain timeout")
+	}
+	if c.CircuitBreaker.Sustain < 0 {
+		v.errorf([]any{"circuit_breaker", "sustain"}, "negative sustain period")
+	}
+	if c.CircuitBreaker.ResetAfter < 0 {
+		v.errorf([]any{"circuit_breaker", "reset_after"}, "negative reset period")
+	}
+	if c.Retry.Attempts != nil && *c.Retry.Attempts < 0 {
+		v.errorf([]any{"retry", "attempts"}, "negative number of attempts")
+	}
+	if c.Retry.Backoff < 0 || c.Retry.MaxBackoff < 0 {
+		v.errorf([]any{"retry"}, "negative backoff")
+	}
+	if c.Retry.QueueSize < 0 {
+		v.errorf([]any{"retry", "queue_size"}, "negative queue size")
+	}
+	limit := c.RateLimit.build(v, []any{"rate_limit"})
+	var dedup *dedupCache
+	switch {
+	case c.Dedup.Window < 0:
+		v.errorf([]any{"dedup", "window"}, "negative window")
+	case c.Dedup.Size < 0:
+		v.errorf([]any{"dedup", "size"}, "negative size")
+	case c.Dedup.Window > 0:
+		dedup = newDedupCache(c.Dedup.Window, c.Dedup.Size)
+	}
+	if c.Fragments.Window < 0 {
+		v.errorf([]any{"fragments", "window"}, "negative window")
+	}
+	if c.Fragments.Size < 0 {
+		v.errorf([]any{"fragments", "size"}, "negative size")
+	}
+	fragments := newFragmentCache(c.Fragments.Window, c.Fragments.Size)
+	greKeys := newGREKeyCache()
+	actions := c.buildActions(v)
+	protect, protectCtMark := c.Protect.build(v, []any{"protect"})
+	if len(c.Listeners) == 0 {
+		v.errorf([]any{"listeners"}, "no listeners configured")
+	}
+	var listeners []*listener
+	names := make(map[string]bool)
+	groups := make(map[string]bool)
+	for i, lc := range c.Listeners {
+		path := []any{"listeners", i}
+		if lc == nil {
+			v.errorf(path, "missing listener definition")
+			continue
+		}
+		l := lc.build(v, path, actions)
+		if l == nil {
+			continue
+		}
+		if names[l.name] {
+			v.errorf(field(path, "name"), "duplicate listener name %q", l.name)
+		}
+		names[l.name] = true
+		if groups[l.bindKey()] {
+			v.errorf(field(path, "group"), "NFLOG group %d is already used by another listener", l.group)
+		}
+		groups[l.bindKey()] = true
+		l.debug = l.debug || c.Logging.Debug
+		l.protect = protect
+		l.protectCtMark = protectCtMark
+		l.limit = limit
+		l.dedup = dedup
+		l.fragments = fragments
+		l.greKeys = greKeys
+		l.hostPairFallback = c.Fragments.HostPairFallback
+		listeners = append(listeners, l)
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	return listeners, nil
+}
+
+// build returns the token bucket of a rate limit or nil if no rate limit is configured
+func (rc *rateLimitConfig) build(v *validator, path []any) *tokenBucket {
+	if rc == nil {
+		return nil
+	}
+	if rc.Rate <= 0 {
+		v.errorf(field(path, "rate"), "rate has to be positive")
+		return nil
+	}
+	if rc.Burst < 0 {
+		v.errorf(field(path, "burst"), "negative burst")
+		return nil
+	}
+	return newTokenBucket(rc.Rate, rc.Burst)
+}
+
+// build returns a matcher for the protected conntrack entries or nil if nothing is protected and whether the
+// protection depends on the conntrack mark
+func (pc *protectConfig) build(v *validator, path []any) (matcher, bool) {
+	var matchers []matcher
+	ctMark := len(pc.Marks) > 0
+	for i, s := range pc.Networks {
+		ipNet, err := parseNet(s)
+		if err != nil {
+			v.errorf(field(path, "networks", i), "%v", err)
+			continue
+		}
+		matchers = append(matchers, matchAnyAddress(ipNet))
+	}
+	for i, s := range pc.Ports {
+		r, err := parsePortRange(s)
+		if err != nil {
+			v.errorf(field(path, "ports", i), "%v", err)
+			continue
+		}
+		matchers = append(matchers, matchAnyPort(r))
+	}
+	for _, zone := range pc.Zones {
+		matchers = append(matchers, matchZone(zone))
+	}
+	for i, s := range pc.Marks {
+		m, err := parseMarkMask(s)
+		if err != nil {
+			v.errorf(field(path, "marks", i), "%v", err)
+			continue
+		}
+		matchers = append(matchers, matchCtMark(m))
+	}
+	for i, s := range pc.Filters {
+		node, err := parseFilter(s)
+		if err != nil {
+			v.errorf(field(path, "filters", i), "%v", err)
+			continue
+		}
+		matchers = append(matchers, node.match)
+		ctMark = ctMark || usesCtMark(node)
+	}
+	if len(matchers) == 0 {
+		return nil, false
+	}
+	return matchAny(matchers...), ctMark
+}
+
+func (lc *listenerConfig) build(v *validator, path []any, actions map[string]*action) *listener {
+	if lc.Group == nil {
+		v.errorf(field(path, "group"), "missing NFLOG group")
+		return nil
+	}
+	l := &listener{
+		name:       lc.Name,
+		group:      *lc.Group,
+		netns:      lc.NetNS,
+		copyMode:   nflog.CopyPacket,
+		copyRange:  lc.CopyRange,
+		qthresh:    lc.QThresh,
+		timeout:    lc.Timeout,
+		flags:      nflog.FlagConntrack,
+		debug:      lc.Debug,
+		zone:       lc.Zone,
+		ifaceZones: lc.InterfaceZones,
+		tryZones:   lc.TryZones,
+		deleteByID: lc.DeleteByID == nil || *lc.DeleteByID,
+	}
+	if l.name == "" {
+		l.name = strconv.Itoa(int(l.group))
+	}
+	if l.netns != "" {
+		validateNetNS(v, field(path, "netns"), l.netns)
+	}
+	l.tunnel = lc.Tunnels.build(v, field(path, "tunnels"))
+	switch lc.CopyMode {
+	case "", "packet":
+	case "meta":
+		l.copyMode = nflog.CopyMeta
+	default:
+		v.errorf(field(path, "copy_mode"), "unknown copy mode %q", lc.CopyMode)
+	}
+	if lc.ConntrackInfo != nil && !*lc.ConntrackInfo {
+		l.flags = 0
+	}
+	for i, name := range lc.GenericProtocols {
+		number, err := parseProtocol(name)
+		if err != nil {
+			v.errorf(field(path, "generic_protocols", i), "%v", err)
+			continue
+		}
+		if decodedProtocols[number] {
+			v.errorf(field(path, "generic_protocols", i), "protocol %s is decoded with ports or identifiers", name)
+			continue
+		}
+		if l.genericProtocols == nil {
+			l.genericProtocols = make(map[uint8]bool)
+		}
+		l.genericProtocols[number] = true
+	}
+	if lc.Zone != nil && len(lc.TryZones) > 0 {
+		v.errorf(field(path, "try_zones"), "zone and try_zones are mutually exclusive")
+	}
+	if l.copyMode == nflog.CopyMeta && l.flags == 0 {
+		v.errorf(field(path, "conntrack_info"), "either the packet payload or the conntrack info is needed")
+	}
+	for i, rc := range lc.Rules {
+		rulePath := field(path, "rules", i)
+		if rc == nil {
+			v.errorf(rulePath, "missing rule definition")
+			continue
+		}
+		if r := rc.build(v, rulePath, actions); r != nil {
+			l.rules = append(l.rules, r)
+		}
+	}
+	defaultAction := lc.Action
+	if defaultAction == "" {
+		defaultAction = actionDelete
+		if len(lc.Rules) > 0 {
+			defaultAction = actionIgnore
+		}
+	}
+	if a, ok := actions[defaultAction]; ok {
+		l.action = a
+	} else {
+		v.errorf(field(path, "action"), "unknown action %q", defaultAction)
+	}
+	return l
+}
+
+// validateNetNS checks that a network namespace path exists and is not a directory
+func validateNetNS(v *validator, path []any, netns string) {
+	if info, err := os.Stat(netns); err != nil {
+		v.errorf(path, "%v", err)
+	} else if info.IsDir() {
+		v.errorf(path, "%s is a directory", netns)
+	}
+}
+
+func (rc *ruleConfig) build(v *validator, path []any, actions map[string]*action) *rule {
+	r := &rule{name: rc.Name, dedup: rc.Dedup == nil || *rc.Dedup}
+	if r.name == "" {
+		r.name = strconv.Itoa(path[len(path)-1].(int))
+	}
+	a, ok := actions[rc.Action]
+	switch {
+	case rc.Action == "":
+		v.errorf(field(path, "action"), "missing action")
+	case !ok:
+		v.errorf(field(path, "action"), "unknown action %q", rc.Action)
+	default:
+		r.action = a
+	}
+	r.match = rc.Match.build(v, field(path, "match"))
+	r.limit = rc.RateLimit.build(v, field(path, "rate_limit"))
+	r.conditions = rc.Conditions.build(v, field(path, "conditions"))
+	if rc.Filter != "" {
+		if m, err := compileFilter(rc.Filter); err != nil {
+			v.errorf(field(path, "filter"), "%v", err)
+		} else {
+			r.match = matchAll(r.match, m)
+		}
+	}
+	return r
+}
+
+func (mc *matchConfig) build(v *validator, path []any) matcher {
+	var matchers []matcher
+	if mc.Family != "" {
+		if family, err := parseFamily(mc.Family); err != nil {
+			v.errorf(field(path, "family"), "%v", err)
+		} else {
+			matchers = append(matchers, matchFamily(family))
+		}
+	}
+	if len(mc.Protocol) > 0 {
+		var numbers []uint8
+		for i, s := range mc.Protocol {
+			number, err := parseProtocol(s)
+			if err != nil {
+				v.errorf(field(path, "protocol", i), "%v", err)
+				continue
+			}
+			numbers = append(numbers, number)
+		}
+		matchers = append(matchers, matchProtocols(numbers))
+	}
+	for _, nets := range []struct {
+		name   string
+		values []string
+		dst    bool
+	}{{"src", mc.Src, false}, {"dst", mc.Dst, true}} {
+		if len(nets.values) == 0 {
+			continue
+		}
+		var ipNets []*net.IPNet
+		for i, s := range nets.values {
+			ipNet, err := parseNet(s)
+			if err != nil {
+				v.errorf(field(path, nets.name, i), "%v", err)
+				continue
+			}
+			ipNets = append(ipNets, ipNet)
+		}
+		matchers = append(matchers, matchNets(ipNets, nets.dst))
+	}
+	for _, ports := range []struct {
+		name   string
+		values []string
+		dst    bool
+	}{{"sport", mc.SrcPort, false}, {"dport", mc.DstPort, true}} {
+		if len(ports.values) == 0 {
+			continue
+		}
+		var ranges []portRange
+		for i, s := range ports.values {
+			r, err := parsePortRange(s)
+			if err != nil {
+				v.errorf(field(path, ports.name, i), "%v", err)
+				continue
+			}
+			ranges = append(ranges, r)
+		}
+		matchers = append(matchers, matchPorts(ranges, ports.dst))
+	}
+	if mc.Mark != "" {
+		if m, err := parseMarkMask(mc.Mark); err != nil {
+			v.errorf(field(path, "mark"), "%v", err)
+		} else {
+			matchers = append(matchers, matchMark(m))
+		}
+	}
+	if mc.CtMark != "" {
+		if m, err := parseMarkMask(mc.CtMark); err != nil {
+			v.errorf(field(path, "ctmark"), "%v", err)
+		} else {
+			matchers = append(matchers, matchCtMark(m))
+		}
+	}
+	if mc.Prefix != "" {
+		matchers = append(matchers, matchPrefix(mc.Prefix))
+	}
+	if mc.InIface != "" {
+		matchers = append(matchers, matchInterface(mc.InIface, false))
+	}
+	if mc.OutIface != "" {
+		matchers = append(matchers, matchInterface(mc.OutIface, true))
+	}
+	return matchAll(matchers...)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+
+	conntrack "github.com/florianl/go-conntrack"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// go-conntrack does not encode the zone of a conntrack entry, requests in a zone are encoded here
+
+// ctnetlink attribute types from linux/netfilter/nfnetlink_conntrack.h
+const (
+	ctaTupleOrig   = 1
+	ctaTupleReply  = 2
+	ctaStatus      = 3
+	ctaTimeout     = 7
+	ctaMark        = 8
+	ctaTupleMaster = 9
+	ctaID          = 12
+	ctaZone        = 18
+	ctaMarkMask    = 21
+
+	ctaTupleIP    = 1
+	ctaTupleProto = 2
+
+	ctaIPv4Src = 1
+	ctaIPv4Dst = 2
+	ctaIPv6Src = 3
+	ctaIPv6Dst = 4
+
+	ctaProtoNum        = 1
+	ctaProtoSrcPort    = 2
+	ctaProtoDstPort    = 3
+	ctaProtoIcmpID     = 4
+	ctaProtoIcmpType   = 5
+	ctaProtoIcmpCode   = 6
+	ctaProtoIcmpv6ID   = 7
+	ctaProtoIcmpv6Type = 8
+	ctaProtoIcmpv6Code = 9
+
+	ipctnlMsgCtNew    = 0
+	ipctnlMsgCtGet    = 1
+	ipctnlMsgCtDelete = 2
+)
+
+// deleteConntrack deletes a conntrack entry, in the zone of the entry if it has one
+func deleteConntrack(nfct *conntrack.Nfct, family conntrack.Family, con conntrack.Con) error {
+	if con.Zone == nil {
+		return nfct.Delete(conntrack.Conntrack, family, con)
+	}
+	req, err := ctRequest(ipctnlMsgCtDelete, family, con)
+	if err != nil {
+		return err
+	}
+	_, err = nfct.Con.Execute(req)
+	return err
+}
+
+// updateConntrack changes the mark, timeout and status of a conntrack entry, in the zone of the entry if it has one
+func updateConntrack(nfct *conntrack.Nfct, family conntrack.Family, con conntrack.Con) error {
+	if con.Zone == nil {
+		return nfct.Update(conntrack.Conntrack, family, con)
+	}
+	req, err := ctRequest(ipctnlMsgCtNew, family, con)
+	if err != nil {
+		return err
+	}
+	_, err = nfct.Con.Execute(req)
+	return err
+}
+
+// getConntrack returns the conntrack entry with a tuple, in the zone of the entry if it has one
+func getConntrack(nfct *conntrack.Nfct, logger *log.Logger, family conntrack.Family, con conntrack.Con) (conntrack.Con, error) {
+	if con.Zone == nil {
+		entries, err := nfct.Get(conntrack.Conntrack, family, con)
+		if err != nil {
+			return conntrack.Con{}, err
+		}
+		if len(entries) == 0 {
+			return conntrack.Con{}, unix.ENOENT
+		}
+		return entries[0], nil
+	}
+	req, err := ctRequest(ipctnlMsgCtGet, family, con)
+	if err != nil {
+		return conntrack.Con{}, err
+	}
+	msgs, err := nfct.Con.Execute(req)
+	if err != nil {
+		return conntrack.Con{}, err
+	}
+	for _, msg := range msgs {
+		if len(msg.Data) > 4 {
+			return conntrack.ParseAttributes(logger, msg.Data)
+		}
+	}
+	return conntrack.Con{}, unix.ENOENT
+}
+
+// relatedConntrack returns the conntrack entries whose master is the given entry, go-conntrack does not decode the
+// master tuple of an entry so the table is dumped here
+func relatedConntrack(nfct *conntrack.Nfct, family conntrack.Family, master conntrack.Con) ([]conntrack.Con, error) {
+	// go-conntrack logs the master tuple as unknown attribute
+	logger := log.New(io.Discard, "", 0)
+	msgs, err := nfct.Con.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK<<8 | ipctnlMsgCtGet),
+			Flags: netlink.Request | netlink.Dump,
+		},
+		Data: []byte{uint8(family), unix.NFNETLINK_V0, 0, 0},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not dump conntrack table: %v", err)
+	}
+	var related []conntrack.Con
+	for _, msg := range msgs {
+		if len(msg.Data) <= 4 {
+			continue
+		}
+		ad, err := netlink.NewAttributeDecoder(msg.Data[4:])
+		if err != nil {
+			return nil, err
+		}
+		var masterTuple []byte
+		for ad.Next() {
+			if ad.Type() == ctaTupleMaster {
+				masterTuple = ad.Bytes()
+			}
+		}
+		if err := ad.Err(); err != nil {
+			return nil, err
+		}
+		if masterTuple == nil {
+			continue
+		}
+		// the master tuple has the layout of the original tuple, which go-conntrack decodes
+		ae := netlink.NewAttributeEncoder()
+		ae.Bytes(ctaTupleOrig|unix.NLA_F_NESTED, masterTuple)
+		attrs, err := ae.Encode()
+		if err != nil {
+			return nil, err
+		}
+		m, err := conntrack.ParseAttributes(logger, append([]byte{uint8(family), unix.NFNETLINK_V0, 0, 0}, attrs...))
+		if err != nil {
+			return nil, err
+		}
+		if !sameTuple(m.Origin, master.Origin) {
+			continue
+		}
+		con, err := conntrack.ParseAttributes(logger, msg.Data)
+		if err != nil {
+			return nil, err
+		}
+		if sameZone(con.Zone, master.Zone) {
+			related = append(related, con)
+		}
+	}
+	return related, nil
+}
+
+// ctRequest encodes a ctnetlink request for the conntrack entry with the tuples, ID and zone of a connection and the
+// status, timeout and mark to change
+func ctRequest(msgType int, family conntrack.Family, con conntrack.Con) (netlink.Message, error) {
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	if con.Origin != nil {
+		ae.Nested(ctaTupleOrig, func(nae *netlink.AttributeEncoder) error { return encodeTuple(nae, con.Origin) })
+	}
+	if con.Reply != nil {
+		ae.Nested(ctaTupleReply, func(nae *netlink.AttributeEncoder) error { return encodeTuple(nae, con.Reply) })
+	}
+	if con.ID != nil {
+		ae.Uint32(ctaID, *con.ID)
+	}
+	if con.Zone != nil {
+		ae.Uint16(ctaZone, *con.Zone)
+	}
+	for _, a := range []struct {
+		typ uint16
+		v   *uint32
+	}{{ctaStatus, con.Status}, {ctaTimeout, con.Timeout}, {ctaMark, con.Mark}, {ctaMarkMask, con.MarkMask}} {
+		if a.v != nil {
+			ae.Uint32(a.typ, *a.v)
+		}
+	}
+	attrs, err := ae.Encode()
+	if err != nil {
+		return netlink.Message{}, err
+	}
+	return netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK<<8 | msgType),
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		Data: append([]byte{uint8(family), unix.NFNETLINK_V0, 0, 0}, attrs...),
+	}, nil
+}
+
+func encodeTuple(ae *netlink.AttributeEncoder, t *conntrack.IPTuple) error {
+	ae.Nested(ctaTupleIP, func(nae *netlink.AttributeEncoder) error {
+		if t.Src != nil {
+			if ip4 := t.Src.To4(); ip4 != nil {
+				nae.Bytes(ctaIPv4Src, ip4)
+			} else {
+				nae.Bytes(ctaIPv6Src, t.Src.To16())
+			}
+		}
+		if t.Dst != nil {
+			if ip4 := t.Dst.To4(); ip4 != nil {
+				nae.Bytes(ctaIPv4Dst, ip4)
+			} else {
+				nae.Bytes(ctaIPv6Dst, t.Dst.To16())
+			}
+		}
+		return nil
+	})
+	if p := t.Proto; p != nil {
+		ae.Nested(ctaTupleProto, func(nae *netlink.AttributeEncoder) error {
+			for _, a := range []struct {
+				typ uint16
+				v   *uint8
+			}{{ctaProtoNum, p.Number}, {ctaProtoIcmpType, p.IcmpType}, {ctaProtoIcmpCode, p.IcmpCode}, {ctaProtoIcmpv6Type, p.Icmpv6Type}, {ctaProtoIcmpv6Code, p.Icmpv6Code}} {
+				if a.v != nil {
+					nae.Uint8(a.typ, *a.v)
+				}
+			}
+			for _, a := range []struct {
+				typ uint16
+				v   *uint16
+			}{{ctaProtoSrcPort, p.SrcPort}, {ctaProtoDstPort, p.DstPort}, {ctaProtoIcmpID, p.IcmpID}, {ctaProtoIcmpv6ID, p.Icmpv6ID}} {
+				if a.v != nil {
+					nae.Uint16(a.typ, *a.v)
+				}
+			}
+			return nil
+		})
+	}
+	return nil
+}
@@ -9,13 +9,15 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	conntrack "github.com/florianl/go-conntrack"
-	nflog "github.com/florianl/go-nflog/v2"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/mdlayher/netlink"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	ctprint "github.com/x-way/iptables-tracer/pkg/ctprint"
@@ -24,9 +26,21 @@ import (
 )
 
 var (
-	nflogGroup    = flag.Int("g", 666, "NFLOG group to listen on")
+	listenerFlags listenerList
+	configFile    = flag.String("c", "", "path of the configuration file")
 	debug         = flag.Bool("d", false, "debug output")
 	metricsSocket = flag.String("m", "", "path of UNIX socket to use for exposing prometheus metrics")
+	dryRunFlag    = flag.Bool("n", false, "dry-run, only log the conntrack entries which would be deleted")
+)
+
+// dryRunEnabled is the global dry-run mode, it can be toggled at runtime
+var dryRunEnabled atomic.Bool
+
+const (
+	exitOK           = 0
+	exitFailure      = 1
+	exitConfigError  = 2
+	exitDrainTimeout = 3
 )
 
 var (
@@ -35,164 +49,461 @@ var (
 			Name: "ctrmd_errors_total",
 			Help: "The total number of errors",
 		},
-		[]string{"family", "protocol", "ctinfo", "type"},
+		[]string{"listener", "family", "protocol", "ctinfo", "type"},
 	)
 	deleteCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "ctrmd_deletions_total",
 			Help: "The total number of deleted conntrack entries",
 		},
-		[]string{"family", "protocol", "ctinfo"},
+		[]string{"listener", "family", "protocol", "ctinfo", "zone"},
+	)
+	updateCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ctrmd_updates_total",
+			Help: "The total number of conntrack entries updated by update actions",
+		},
+		[]string{"listener", "family", "protocol", "ctinfo", "zone"},
+	)
+	icmpErrorCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ctrmd_icmp_error_deletions_total",
+			Help: "The total number of conntrack entries deleted using the packet embedded in an ICMP error message",
+		},
+		[]string{"listener", "family", "protocol", "ctinfo"},
+	)
+	logCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ctrmd_logged_total",
+			Help: "The total number of conntrack entries logged without deletion",
+		},
+		[]string{"listener", "family", "protocol", "ctinfo"},
+	)
+	reloadCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ctrmd_config_reloads_total",
+			Help: "The total number of configuration reloads",
+		},
+		[]string{"result"},
+	)
+	reloadSuccessGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "ctrmd_config_last_reload_successful",
+			Help: "Whether the last configuration reload was successful",
+		},
+	)
+	reloadTimestampGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "ctrmd_config_last_reload_success_timestamp_seconds",
+			Help: "Timestamp of the last successful configuration reload",
+		},
+	)
+	listenerUpGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ctrmd_listener_up",
+			Help: "Whether the NFLOG subscription of the listener is established",
+		},
+		[]string{"listener"},
+	)
+	dryRunCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ctrmd_dryrun_matches_total",
+			Help: "The total number of conntrack entries which would have been deleted or updated in dry-run mode",
+		},
+		[]string{"listener", "family", "protocol", "ctinfo"},
+	)
+	protectedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ctrmd_protected_total",
+			Help: "The total number of protected conntrack entries which were not deleted or updated",
+		},
+		[]string{"listener", "family", "protocol", "ctinfo"},
+	)
+	rateLimitedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ctrmd_rate_limited_total",
+			Help: "The total number of conntrack entries not deleted or updated because of a rate limit or the open circuit breaker",
+		},
+		[]string{"listener", "reason"},
+	)
+	dedupCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ctrmd_dedup_lookups_total",
+			Help: "The total number of deduplication cache lookups by result",
+		},
+		[]string{"listener", "result"},
+	)
+	notFoundCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ctrmd_delete_not_found_total",
+			Help: "The total number of conntrack entries which were already gone when deleting them",
+		},
+		[]string{"listener", "family", "protocol", "ctinfo", "zone"},
+	)
+	idMismatchCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ctrmd_delete_id_mismatch_total",
+			Help: "The total number of conntrack entries not deleted because their tuple was reused by a newer connection",
+		},
+		[]string{"listener", "family", "protocol", "ctinfo"},
+	)
+	skippedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ctrmd_condition_skipped_total",
+			Help: "The total number of conntrack entries not deleted or updated because they did not meet a condition of the rule",
+		},
+		[]string{"listener", "rule", "condition"},
+	)
+	retryCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ctrmd_delete_retries_total",
+			Help: "The total number of deletions queued for a retry after a transient error",
+		},
+		[]string{"listener", "reason"},
+	)
+	retryQueueGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "ctrmd_delete_retry_queue_length",
+			Help: "The number of deletions waiting for a retry",
+		},
+	)
+	deadLetterCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ctrmd_dead_letters_total",
+			Help: "The total number of deletions which failed permanently and were written to the dead-letter log",
+		},
+		[]string{"listener", "reason"},
+	)
+	fragmentCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ctrmd_fragments_total",
+			Help: "The total number of IP fragments decoded from the packet payload by how their tuple was resolved",
+		},
+		[]string{"listener", "result"},
+	)
+	tunnelCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ctrmd_tunnel_packets_total",
+			Help: "The total number of decapsulated tunnel packets by tunnel protocol",
+		},
+		[]string{"listener", "tunnel"},
+	)
+	scopeLimitCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ctrmd_scope_max_entries_total",
+			Help: "The total number of packets not handled because their wildcard scope selected more than the maximum number of entries",
+		},
+		[]string{"listener"},
+	)
+	cascadeCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ctrmd_cascade_deleted_total",
+			Help: "The total number of expectations and related conntrack entries deleted together with their master entry",
+		},
+		[]string{"listener", "type"},
+	)
+	circuitBreakerGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "ctrmd_circuit_breaker_open",
+			Help: "Whether the circuit breaker is open and deletions are only logged",
+		},
+	)
+	dryRunGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "ctrmd_dryrun_enabled",
+			Help: "Whether the global dry-run mode is enabled",
+		},
+	)
+	restartCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ctrmd_listener_restarts_total",
+			Help: "The total number of NFLOG resubscriptions after receive failures",
+		},
+		[]string{"listener", "reason"},
 	)
 )
 
 func init() {
+	flag.Var(&listenerFlags, "g", "NFLOG group to listen on as GROUP[:ACTION][:debug] with ACTION delete (default) or log, may be repeated (default 666)")
 	prometheus.MustRegister(errorCounter)
 	prometheus.MustRegister(deleteCounter)
+	prometheus.MustRegister(updateCounter)
+	prometheus.MustRegister(logCounter)
+	prometheus.MustRegister(icmpErrorCounter)
+	prometheus.MustRegister(reloadCounter)
+	prometheus.MustRegister(reloadSuccessGauge)
+	prometheus.MustRegister(reloadTimestampGauge)
+	prometheus.MustRegister(listenerUpGauge)
+	prometheus.MustRegister(restartCounter)
+	prometheus.MustRegister(dryRunCounter)
+	prometheus.MustRegister(dryRunGauge)
+	prometheus.MustRegister(protectedCounter)
+	prometheus.MustRegister(rateLimitedCounter)
+	prometheus.MustRegister(circuitBreakerGauge)
+	prometheus.MustRegister(dedupCounter)
+	prometheus.MustRegister(notFoundCounter)
+	prometheus.MustRegister(idMismatchCounter)
+	prometheus.MustRegister(skippedCounter)
+	prometheus.MustRegister(retryCounter)
+	prometheus.MustRegister(retryQueueGauge)
+	prometheus.MustRegister(deadLetterCounter)
+	prometheus.MustRegister(fragmentCounter)
+	prometheus.MustRegister(tunnelCounter)
+	prometheus.MustRegister(scopeLimitCounter)
+	prometheus.MustRegister(cascadeCounter)
 }
 
 func main() {
-	syslogger, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "ctrmd")
-	if err != nil {
-		log.Fatal("Could not create syslog logger: ", err)
-	}
-	logger := log.New(syslogger, "", log.LstdFlags)
 	flag.Parse()
 
-	if *debug {
-		logger.SetOutput(os.Stdout)
+	switch flag.Arg(0) {
+	case "":
+	case "check-config":
+		os.Exit(checkConfig())
+	case "check-filter":
+		os.Exit(checkFilter())
+	default:
+		log.Fatalf("Unknown command %q", flag.Arg(0))
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	os.Exit(run())
+}
 
-	if *metricsSocket != "" {
-		startMetricsServer(ctx, logger, *metricsSocket)
+// run starts the daemon and blocks until it is terminated, it returns the exit code of the process
+func run() int {
+	cfg, err := readConfig()
+	if err != nil {
+		log.Printf("Could not read configuration: %v", err)
+		return exitConfigError
 	}
-
-	logger.Print("Opening conntrack socket")
-	nfct, err := conntrack.Open(&conntrack.Config{})
+	listeners, err := cfg.build()
 	if err != nil {
-		logger.Fatalf("Could not open conntrack socket: %v", err)
+		log.Printf("Invalid configuration:\n%v", err)
+		return exitConfigError
 	}
-	defer nfct.Close()
 
-	config := nflog.Config{
-		Group:       uint16(*nflogGroup),
-		Copymode:    nflog.CopyPacket,
-		Flags:       nflog.FlagConntrack,
-		ReadTimeout: 30 * time.Second,
-	}
-	logger.Printf("Opening NFLOG socket for group %d", *nflogGroup)
-	nfl, err := nflog.Open(&config)
+	logger, err := newLogger(cfg.Logging)
 	if err != nil {
-		logger.Fatalf("Could not open nflog socket: %v", err)
+		log.Print("Could not create logger: ", err)
+		return exitFailure
 	}
-	defer nfl.Close()
+	defer flushLogger(logger)
 
-	fn := func(m nflog.Attribute) int {
-		var ctFamily conntrack.Family
-		var con conntrack.Con
-		var err error
-		var ctBytes []byte
-		var payloadBytes []byte
-		var fwMark uint32
-		var iif string
-		var oif string
-		familyStr := "unknown"
-		protoStr := "0"
-		ctinfoStr := "0x0"
-		ctInfo := ^uint32(0)
-		if m.CtInfo != nil {
-			ctInfo = *m.CtInfo
-			ctinfoStr = fmt.Sprintf("0x%x", ctInfo)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	// the default action of these signals terminates the process, they are caught before readiness is notified
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	defer signal.Stop(usr1)
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	defer signal.Stop(usr2)
+
+	d := newDaemon(ctx, logger, cfg)
+
+	mux := http.NewServeMux()
+	mux.Handle("/", promhttp.Handler())
+	mux.HandleFunc("/healthz", d.serveHealth)
+	// the control endpoints are only served on UNIX sockets, whose access is restricted by the file permissions
+	controlMux := http.NewServeMux()
+	controlMux.Handle("/", mux)
+	controlMux.HandleFunc("/control/dry-run", d.serveDryRun)
+	controlMux.HandleFunc("/control/circuit-breaker", d.serveCircuitBreaker)
+	metricsListeners, err := activationListeners()
+	if err != nil {
+		logger.Print(err)
+	}
+	for _, l := range metricsListeners {
+		logger.Printf("Using metrics socket %s from systemd socket activation", l.Addr())
+	}
+	if cfg.Metrics.Socket != "" {
+		if l := listenMetrics(logger, "unix", cfg.Metrics.Socket); l != nil {
+			metricsListeners = append(metricsListeners, l)
 		}
-		if m.HwProtocol != nil {
-			switch *m.HwProtocol {
-			case unix.ETH_P_IP:
-				ctFamily = conntrack.IPv4
-				familyStr = "inet"
-			case unix.ETH_P_IPV6:
-				ctFamily = conntrack.IPv6
-				familyStr = "inet6"
-			}
+	}
+	if cfg.Metrics.Address != "" {
+		if l := listenMetrics(logger, "tcp", cfg.Metrics.Address); l != nil {
+			metricsListeners = append(metricsListeners, l)
 		}
-		if m.Ct != nil {
-			ctBytes = *m.Ct
-			if con, err = conntrack.ParseAttributes(logger, ctBytes); err != nil {
-				logger.Printf("Could not extract Con from CT info: %v", err)
-				errorCounter.WithLabelValues(familyStr, protoStr, ctinfoStr, "ctinfo_extract").Inc()
-				return 0
-			}
-		} else {
-			if *debug {
-				logger.Print("No NFLOG CT info found, decoding information from payload")
-			}
+	}
+	metricsCtx, stopMetrics := context.WithCancel(context.Background())
+	var metricsDone []<-chan struct{}
+	for _, l := range metricsListeners {
+		var handler http.Handler = mux
+		if l.Addr().Network() == "unix" {
+			handler = controlMux
 		}
-		if m.Payload != nil {
-			payloadBytes = *m.Payload
-			if con.Origin == nil {
-				if con, err = extractConFromPayload(payloadBytes); err != nil {
-					logger.Printf("Could not extract CT attrs from packet payload: %v", err)
-					errorCounter.WithLabelValues(familyStr, protoStr, ctinfoStr, "payload_extract").Inc()
-					return 0
-				}
-			}
-		} else {
-			logger.Print("No NFLOG payload found, ignoring packet")
-			errorCounter.WithLabelValues(familyStr, protoStr, ctinfoStr, "no_payload").Inc()
-			return 0
+		metricsDone = append(metricsDone, startMetricsServer(metricsCtx, logger, l, handler))
+	}
+	defer func() {
+		stopMetrics()
+		for _, done := range metricsDone {
+			<-done
 		}
-		if m.Mark != nil {
-			fwMark = *m.Mark
+	}()
+
+	reloadSuccessGauge.Set(1)
+	reloadTimestampGauge.SetToCurrentTime()
+	setDryRun(logger, cfg.DryRun)
+	breaker.configure(logger, cfg.CircuitBreaker)
+	if err := d.retries.configure(logger, cfg.Retry, cfg.DeadLetter); err != nil {
+		logger.Print(err)
+	}
+	go d.retries.run(ctx, &d.inflight)
+
+	watchdog := watchdogInterval()
+	if watchdog > 0 {
+		// idle receive loops have to beat their heartbeat within the watchdog interval
+		d.readTimeout = min(d.readTimeout, watchdog/2)
+	}
+	if err := d.apply(listeners); err != nil {
+		logger.Print(err)
+		return exitFailure
+	}
+	if err := sdNotify("READY=1"); err != nil {
+		logger.Printf("Could not notify systemd: %v", err)
+	}
+	if watchdog > 0 {
+		logger.Printf("Enabling systemd watchdog with interval %s", watchdog)
+		go runWatchdog(ctx, watchdog, d.alive)
+	}
+
+	for {
+		select {
+		case <-hup:
+			d.reload()
+		case <-usr1:
+			setDryRun(logger, !dryRunEnabled.Load())
+		case <-usr2:
+			breaker.reset()
+		case <-ctx.Done():
+			// restore the default signal behaviour, a second signal terminates immediately
+			stop()
+			sdNotify("STOPPING=1")
+			logger.Print("Terminating, waiting for in-flight deletions")
+			if !d.shutdown(d.cfg.drainTimeout()) {
+				logger.Printf("In-flight deletions and retries did not finish within %s", d.cfg.drainTimeout())
+				return exitDrainTimeout
+			}
+			logger.Print("Terminated")
+			return exitOK
 		}
-		if m.InDev != nil {
-			iif = GetIfaceName(*m.InDev)
+	}
+}
+
+// readConfig returns the configuration from the file given with -c or from the command line flags
+func readConfig() (*config, error) {
+	var cfg *config
+	if *configFile != "" {
+		if len(listenerFlags) > 0 {
+			return nil, fmt.Errorf("-g cannot be combined with -c")
 		}
-		if m.OutDev != nil {
-			oif = GetIfaceName(*m.OutDev)
+		var err error
+		if cfg, err = loadConfig(*configFile); err != nil {
+			return nil, err
 		}
-		if con.Origin != nil {
-			if con.Origin.Proto != nil && con.Origin.Proto.Number != nil {
-				protoStr = fmt.Sprintf("%d", *con.Origin.Proto.Number)
-			}
-			var ctEntry string
-			if ctEntry, err = ctprint.Format(ctBytes); err != nil {
-				logger.Printf("Could not format ctBytes: %s", err)
-			}
-			logger.Printf("Deleting CT entry: %s", ctEntry)
-			if *debug {
-				logger.Printf("  Packet: %s", formatPkt(ctFamily, time.Now(), fwMark, iif, oif, payloadBytes, ctBytes, ctInfo))
-			}
-			if err = nfct.Delete(conntrack.Conntrack, ctFamily, con); err != nil {
-				logger.Printf("conntrack Delete failed: %v", err)
-				errorCounter.WithLabelValues(familyStr, protoStr, ctinfoStr, "delete").Inc()
-			} else {
-				deleteCounter.WithLabelValues(familyStr, protoStr, ctinfoStr).Inc()
+	} else {
+		cfg = &config{Listeners: listenerFlags}
+		if len(cfg.Listeners) == 0 {
+			lc, err := parseListenerSpec("666")
+			if err != nil {
+				return nil, err
 			}
-		} else {
-			logger.Print("List of extracted CT attributes is empty, ignoring packet")
-			errorCounter.WithLabelValues(familyStr, protoStr, ctinfoStr, "no_ctattrs").Inc()
+			cfg.Listeners = append(cfg.Listeners, lc)
 		}
+	}
+	if *debug {
+		cfg.Logging.Debug = true
+		cfg.Logging.Target = "stdout"
+	}
+	if *metricsSocket != "" {
+		cfg.Metrics.Socket = *metricsSocket
+	}
+	if *dryRunFlag {
+		cfg.DryRun = true
+	}
+	return cfg, nil
+}
 
-		return 0
+// checkFilter parses a filter expression and prints it fully parenthesized, it returns the exit code for the check-filter command
+func checkFilter() int {
+	expr := strings.Join(flag.Args()[1:], " ")
+	node, err := parseFilter(expr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, expr)
+		if fe, ok := err.(*filterError); ok {
+			fmt.Fprintf(os.Stderr, "%s^\n", strings.Repeat(" ", fe.pos))
+		}
+		fmt.Fprintln(os.Stderr, err)
+		return 1
 	}
-	errorFn := func(err error) int {
-		if opError, ok := err.(*netlink.OpError); ok {
-			if opError.Timeout() || opError.Temporary() {
-				return 0
-			}
+	fmt.Println(node)
+	return 0
+}
+
+// checkConfig validates the configuration file and returns the exit code for the check-config command
+func checkConfig() int {
+	path := *configFile
+	if flag.Arg(1) != "" {
+		path = flag.Arg(1)
+	}
+	if path == "" {
+		fmt.Fprintln(os.Stderr, "No configuration file given, use -c FILE check-config or check-config FILE")
+		return 2
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		return 1
+	}
+	listeners, err := cfg.build()
+	if err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, line)
 		}
-		logger.Printf("Could not receive message: %v\n", err)
 		return 1
 	}
-	logger.Print("Registering nflog callback")
-	if err := nfl.RegisterWithErrorFunc(ctx, fn, errorFn); err != nil {
-		logger.Fatalf("Could not register nflog callback: %v", err)
+	fmt.Printf("%s: configuration OK (%d listeners)\n", path, len(listeners))
+	return 0
+}
+
+func setDryRun(logger *log.Logger, enabled bool) {
+	if dryRunEnabled.Swap(enabled) != enabled {
+		if enabled {
+			logger.Print("Dry-run mode enabled, conntrack entries will not be deleted")
+		} else {
+			logger.Print("Dry-run mode disabled")
+		}
+	}
+	if enabled {
+		dryRunGauge.Set(1)
+	} else {
+		dryRunGauge.Set(0)
+	}
+}
+
+// flushLogger closes the syslog connection of the logger, output to stdout and stderr is unbuffered
+func flushLogger(logger *log.Logger) {
+	if w, ok := logger.Writer().(*syslog.Writer); ok {
+		w.Close()
 	}
+}
 
-	<-ctx.Done()
-	logger.Print("Terminating")
+func newLogger(cfg loggingConfig) (*log.Logger, error) {
+	switch cfg.Target {
+	case "stdout":
+		return log.New(os.Stdout, "", log.LstdFlags), nil
+	case "stderr":
+		return log.New(os.Stderr, "", log.LstdFlags), nil
+	}
+	syslogger, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "ctrmd")
+	if err != nil {
+		return nil, err
+	}
+	return log.New(syslogger, "", log.LstdFlags), nil
 }
 
 func formatPkt(ctFamily conntrack.Family, ts time.Time, fwMark uint32, iif, oif string, payload, ct []byte, ctInfo uint32) string {
@@ -219,23 +530,36 @@ func GetIfaceName(index uint32) string {
 	return iface.Name
 }
 
-func startMetricsServer(ctx context.Context, logger *log.Logger, socket string) {
-	logger.Printf("Opening metrics socket %s", socket)
-	unixListener, err := net.Listen("unix", socket)
+// listenMetrics opens the metrics socket, it returns nil if the socket could not be opened
+func listenMetrics(logger *log.Logger, network, address string) net.Listener {
+	logger.Printf("Opening metrics socket %s", address)
+	if network == "unix" {
+		if err := removeStaleSocket(address); err != nil {
+			logger.Printf("Could not remove stale metrics socket: %s", err)
+		}
+	}
+	metricsListener, err := net.Listen(network, address)
 	if err != nil {
 		logger.Printf("Could not create metrics socket: %s", err)
-		return
+		return nil
 	}
+	return metricsListener
+}
+
+// startMetricsServer serves the prometheus metrics until ctx is done, the returned channel is closed once the server is shut down
+func startMetricsServer(ctx context.Context, logger *log.Logger, metricsListener net.Listener, handler http.Handler) <-chan struct{} {
 	metricsServer := &http.Server{
-		Handler: promhttp.Handler(),
+		Handler: handler,
 	}
 	go func() {
-		if err := metricsServer.Serve(unixListener); err != nil && err != http.ErrServerClosed {
+		if err := metricsServer.Serve(metricsListener); err != nil && err != http.ErrServerClosed {
 			logger.Printf("Metrics server failed: %s", err)
 		}
-		unixListener.Close()
+		metricsListener.Close()
 	}()
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		<-ctx.Done()
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
@@ -243,4 +567,5 @@ func startMetricsServer(ctx context.Context, logger *log.Logger, socket string)
 			logger.Printf("Could not gracefully shutdown the metrics server: %s", err)
 		}
 	}()
+	return done
 }
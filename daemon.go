@@ -0,0 +1,601 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	conntrack "github.com/florianl/go-conntrack"
+	nflog "github.com/florianl/go-nflog/v2"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	minResubscribeBackoff = time.Second
+	maxResubscribeBackoff = time.Minute
+	// heartbeatInterval is the interval at which the socket supervisors report that they are alive while they wait to
+	// resubscribe
+	heartbeatInterval = time.Second
+	// defaultReadTimeout wakes the receive loops of idle NFLOG sockets to beat their heartbeat
+	defaultReadTimeout = 30 * time.Second
+)
+
+// daemon owns the netlink sockets and the listeners currently attached to them
+type daemon struct {
+	ctx    context.Context
+	logger *log.Logger
+	cfg    *config
+
+	mu         sync.Mutex
+	namespaces map[string]*namespace
+	sockets    map[string]*socket
+
+	inflight inflight
+	retries  *retryQueue
+
+	// readTimeout is the longest time a receive loop blocks without beating its heartbeat
+	readTimeout time.Duration
+}
+
+// inflight tracks the NFLOG messages currently being processed
+type inflight struct {
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// begin registers a message for processing, it returns false once draining started
+func (i *inflight) begin() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.closed {
+		return false
+	}
+	i.wg.Add(1)
+	return true
+}
+
+func (i *inflight) done() {
+	i.wg.Done()
+}
+
+// drain rejects new messages and waits until the messages being processed are done or the timeout expired
+func (i *inflight) drain(timeout time.Duration) bool {
+	i.mu.Lock()
+	i.closed = true
+	i.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		i.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// namespace holds the conntrack socket of a network namespace
+type namespace struct {
+	path string
+	file *os.File
+	nfct *conntrack.Nfct
+}
+
+// socket is a supervised NFLOG subscription, the listener attached to it can be swapped without reopening the socket
+type socket struct {
+	d        *daemon
+	ns       *namespace
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+	failed   chan string
+	up       atomic.Bool
+	listener atomic.Pointer[listener]
+	// heartbeat is the time of the last heartbeat of the receive loop or, while resubscribing, the supervisor in
+	// nanoseconds
+	heartbeat atomic.Int64
+	// conn is the netlink connection of the current subscription
+	conn atomic.Pointer[netlink.Conn]
+
+	mu          sync.Mutex
+	nfl         *nflog.Nflog
+	cancelNflog context.CancelFunc
+}
+
+func newDaemon(ctx context.Context, logger *log.Logger, cfg *config) *daemon {
+	return &daemon{
+		ctx:         ctx,
+		logger:      logger,
+		cfg:         cfg,
+		namespaces:  make(map[string]*namespace),
+		sockets:     make(map[string]*socket),
+		retries:     newRetryQueue(),
+		readTimeout: defaultReadTimeout,
+	}
+}
+
+func openNamespace(path string) (*namespace, error) {
+	ns := &namespace{path: path}
+	if path != "" {
+		var err error
+		if ns.file, err = os.Open(path); err != nil {
+			return nil, fmt.Errorf("could not open network namespace: %v", err)
+		}
+	}
+	nfct, err := conntrack.Open(&conntrack.Config{NetNS: ns.fd()})
+	if err != nil {
+		ns.close()
+		return nil, fmt.Errorf("could not open conntrack socket: %v", err)
+	}
+	ns.nfct = nfct
+	return ns, nil
+}
+
+func (ns *namespace) fd() int {
+	if ns.file == nil {
+		return 0
+	}
+	return int(ns.file.Fd())
+}
+
+func (ns *namespace) close() {
+	if ns.nfct != nil {
+		ns.nfct.Close()
+	}
+	if ns.file != nil {
+		ns.file.Close()
+	}
+}
+
+func (s *socket) handle(m nflog.Attribute) int {
+	s.beat()
+	if !s.d.inflight.begin() {
+		return 1
+	}
+	defer s.d.inflight.done()
+	return s.listener.Load().handle(m)
+}
+
+// handleError ignores timeouts and temporary errors, all other errors end the subscription and trigger a resubscribe
+func (s *socket) handleError(err error) int {
+	s.beat()
+	if opError, ok := err.(*netlink.OpError); ok {
+		if opError.Timeout() || opError.Temporary() {
+			return 0
+		}
+	}
+	reason := "receive_error"
+	if errors.Is(err, unix.ENOBUFS) {
+		reason = "enobufs"
+	}
+	s.listener.Load().logger.Printf("Could not receive message: %v", err)
+	select {
+	case s.failed <- reason:
+	default:
+	}
+	return 1
+}
+
+// attach sets the listener handling the messages of the socket
+func (s *socket) attach(l *listener) {
+	if old := s.listener.Swap(l); old != nil && old.name != l.name {
+		listenerUpGauge.DeleteLabelValues(old.name)
+	}
+	s.setUp(s.up.Load())
+}
+
+func (s *socket) setUp(up bool) {
+	s.up.Store(up)
+	value := 0.0
+	if up {
+		value = 1
+	}
+	listenerUpGauge.WithLabelValues(s.listener.Load().name).Set(value)
+}
+
+// subscribe opens the NFLOG socket and registers the callbacks
+func (s *socket) subscribe() error {
+	l := s.listener.Load()
+	config := nflog.Config{
+		NetNS:       s.ns.fd(),
+		Group:       l.group,
+		Copymode:    l.copyMode,
+		Bufsize:     l.copyRange,
+		QThresh:     l.qthresh,
+		Timeout:     l.timeout,
+		Flags:       l.flags,
+		ReadTimeout: s.d.readTimeout,
+	}
+	nfl, err := nflog.Open(&config)
+	if err != nil {
+		return fmt.Errorf("could not open nflog socket for group %d: %v", l.group, err)
+	}
+	s.conn.Store(nfl.Con)
+	s.beat()
+	ctx, cancel := context.WithCancel(s.ctx)
+	if err := nfl.RegisterWithErrorFunc(ctx, s.handle, s.handleError); err != nil {
+		cancel()
+		s.conn.Store(nil)
+		nfl.Close()
+		return fmt.Errorf("could not register nflog callback for group %d: %v", l.group, err)
+	}
+	s.mu.Lock()
+	s.nfl = nfl
+	s.cancelNflog = cancel
+	s.mu.Unlock()
+	s.setUp(true)
+	return nil
+}
+
+func (s *socket) unsubscribe() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.nfl != nil {
+		s.cancelNflog()
+		s.conn.Store(nil)
+		s.nfl.Close()
+		s.nfl = nil
+	}
+}
+
+// beat records a heartbeat and extends the read deadline of the NFLOG socket, go-nflog does not apply the read timeout
+// itself so the deadline wakes an idle receive loop with a timeout error
+func (s *socket) beat() {
+	s.heartbeat.Store(time.Now().UnixNano())
+	if conn := s.conn.Load(); conn != nil {
+		conn.SetReadDeadline(time.Now().Add(s.d.readTimeout))
+	}
+}
+
+// supervise re-establishes the subscription with exponential backoff whenever receiving fails, it beats the heartbeat
+// while it waits to resubscribe
+func (s *socket) supervise() {
+	defer close(s.done)
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case reason := <-s.failed:
+			l := s.listener.Load()
+			s.setUp(false)
+			restartCounter.WithLabelValues(l.name, reason).Inc()
+			s.unsubscribe()
+			backoff := minResubscribeBackoff
+			for {
+				l.logger.Printf("Resubscribing to NFLOG group %d in %s", l.group, backoff)
+				if !s.wait(backoff) {
+					return
+				}
+				err := s.subscribe()
+				if err == nil {
+					break
+				}
+				l.logger.Printf("Could not resubscribe: %v", err)
+				backoff = min(2*backoff, maxResubscribeBackoff)
+			}
+			l.logger.Printf("Resubscribed to NFLOG group %d", l.group)
+		}
+	}
+}
+
+// wait waits for the backoff while beating the heartbeat, it returns false if the socket was closed
+func (s *socket) wait(backoff time.Duration) bool {
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return false
+		case <-heartbeat.C:
+			s.beat()
+		case <-timer.C:
+			return true
+		}
+	}
+}
+
+func (s *socket) close() {
+	s.cancel()
+	<-s.done
+	s.unsubscribe()
+	listenerUpGauge.DeleteLabelValues(s.listener.Load().name)
+}
+
+func (d *daemon) openSocket(l *listener, ns *namespace) (*socket, error) {
+	d.logger.Printf("Opening NFLOG socket for group %d (listener %s)", l.group, l.name)
+	ctx, cancel := context.WithCancel(d.ctx)
+	s := &socket{
+		d:      d,
+		ns:     ns,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+		failed: make(chan string, 1),
+	}
+	s.listener.Store(l)
+	s.beat()
+	if err := s.subscribe(); err != nil {
+		cancel()
+		listenerUpGauge.DeleteLabelValues(l.name)
+		return nil, err
+	}
+	go s.supervise()
+	return s, nil
+}
+
+// alive reports whether the receive loops of all NFLOG subscriptions beat their heartbeat within maxAge, subscriptions
+// which are down and being resubscribed are alive as long as their supervisor beats
+func (d *daemon) alive(maxAge time.Duration) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, s := range d.sockets {
+		if time.Since(time.Unix(0, s.heartbeat.Load())) > maxAge {
+			return false
+		}
+	}
+	return true
+}
+
+// serveHealth reports the state of the NFLOG subscriptions
+func (d *daemon) serveHealth(w http.ResponseWriter, _ *http.Request) {
+	d.mu.Lock()
+	var lines []string
+	healthy := true
+	for _, s := range d.sockets {
+		l := s.listener.Load()
+		state := "up"
+		if !s.up.Load() {
+			state = "down"
+			healthy = false
+		}
+		lines = append(lines, fmt.Sprintf("listener %s group %d: %s", l.name, l.group, state))
+	}
+	d.mu.Unlock()
+	slices.Sort(lines)
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+}
+
+// apply attaches the given listeners, sockets whose parameters did not change are kept open
+func (d *daemon) apply(listeners []*listener) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	namespaces := make(map[string]*namespace)
+	var opened []*namespace
+	namespaceOf := func(path string) (*namespace, error) {
+		if ns, ok := namespaces[path]; ok {
+			return ns, nil
+		}
+		ns, ok := d.namespaces[path]
+		if !ok {
+			d.logger.Printf("Opening conntrack socket %s", nsName(path))
+			var err error
+			if ns, err = openNamespace(path); err != nil {
+				for _, ns := range opened {
+					ns.close()
+				}
+				return nil, err
+			}
+			opened = append(opened, ns)
+		}
+		namespaces[path] = ns
+		return ns, nil
+	}
+	for _, l := range listeners {
+		ns, err := namespaceOf(l.netns)
+		if err != nil {
+			return err
+		}
+		l.nfct = ns.nfct
+		l.retries = d.retries
+		l.logger = log.New(d.logger.Writer(), fmt.Sprintf("[%s] ", l.name), d.logger.Flags()|log.Lmsgprefix)
+		if t := l.tunnel; t != nil {
+			if ns, err = namespaceOf(cmp.Or(t.netns, l.netns)); err != nil {
+				return err
+			}
+			t.nfct = ns.nfct
+			t.logger = log.New(d.logger.Writer(), fmt.Sprintf("[%s/inner] ", l.name), d.logger.Flags()|log.Lmsgprefix)
+		}
+	}
+
+	sockets := make(map[string]*socket)
+	stale := make(map[string]*socket)
+	for _, l := range listeners {
+		if s, ok := d.sockets[l.socketKey()]; ok {
+			sockets[l.socketKey()] = s
+		}
+	}
+	for key, s := range d.sockets {
+		if _, ok := sockets[key]; !ok {
+			stale[s.listener.Load().bindKey()] = s
+		}
+	}
+
+	// open the sockets for groups which are not bound yet, so that a failure leaves the current configuration untouched
+	var added []*socket
+	for _, l := range listeners {
+		if _, ok := sockets[l.socketKey()]; ok {
+			continue
+		}
+		if _, ok := stale[l.bindKey()]; ok {
+			continue
+		}
+		s, err := d.openSocket(l, namespaces[l.netns])
+		if err != nil {
+			for _, s := range added {
+				s.close()
+			}
+			for _, ns := range opened {
+				ns.close()
+			}
+			return err
+		}
+		added = append(added, s)
+		sockets[l.socketKey()] = s
+	}
+
+	// groups bound with different parameters have to be closed before they can be bound again
+	var errs []error
+	for _, l := range listeners {
+		old, ok := stale[l.bindKey()]
+		if !ok {
+			continue
+		}
+		delete(stale, l.bindKey())
+		oldListener := old.listener.Load()
+		old.close()
+		s, err := d.openSocket(l, namespaces[l.netns])
+		if err != nil {
+			errs = append(errs, err)
+			d.logger.Printf("Could not rebind NFLOG group %d, restoring previous settings: %v", l.group, err)
+			if s, err = d.openSocket(oldListener, old.ns); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			sockets[oldListener.socketKey()] = s
+			namespaces[oldListener.netns] = old.ns
+			continue
+		}
+		sockets[l.socketKey()] = s
+	}
+
+	for _, l := range listeners {
+		if s, ok := sockets[l.socketKey()]; ok {
+			s.attach(l)
+		}
+	}
+	for _, s := range stale {
+		d.logger.Printf("Closing NFLOG socket for group %d", s.listener.Load().group)
+		s.close()
+	}
+	for path, ns := range d.namespaces {
+		if _, ok := namespaces[path]; !ok {
+			d.logger.Printf("Closing conntrack socket %s", nsName(path))
+			d.retries.drop(ns.nfct, fmt.Errorf("conntrack socket %s closed by reload", nsName(path)))
+			ns.close()
+		}
+	}
+	d.sockets = sockets
+	d.namespaces = namespaces
+	return errors.Join(errs...)
+}
+
+// reload reads the configuration again and applies it, an invalid configuration keeps the current one active
+func (d *daemon) reload() {
+	d.logger.Print("Reloading configuration")
+	sdReloading()
+	defer sdNotify("READY=1")
+	cfg, err := readConfig()
+	var listeners []*listener
+	if err == nil {
+		listeners, err = cfg.build()
+	}
+	if err == nil {
+		err = d.apply(listeners)
+	}
+	if err != nil {
+		d.logger.Printf("Configuration reload failed, keeping the current configuration: %s", strings.ReplaceAll(err.Error(), "\n", "; "))
+		reloadCounter.WithLabelValues("failure").Inc()
+		reloadSuccessGauge.Set(0)
+		return
+	}
+	if cfg.DryRun != d.cfg.DryRun {
+		setDryRun(d.logger, cfg.DryRun)
+	}
+	breaker.configure(d.logger, cfg.CircuitBreaker)
+	if err := d.retries.configure(d.logger, cfg.Retry, cfg.DeadLetter); err != nil {
+		d.logger.Print(err)
+	}
+	if cfg.Logging != d.cfg.Logging || cfg.Metrics != d.cfg.Metrics {
+		d.logger.Print("Changes to the logging or metrics settings require a restart")
+	}
+	d.cfg = cfg
+	d.logger.Printf("Configuration reloaded successfully (%d listeners)", len(listeners))
+	reloadCounter.WithLabelValues("success").Inc()
+	reloadSuccessGauge.Set(1)
+	reloadTimestampGauge.SetToCurrentTime()
+}
+
+// shutdown stops receiving NFLOG messages and closes the conntrack sockets once the in-flight messages are processed
+// and the queued retries were attempted a last time, it returns false if the drain timeout expired
+func (d *daemon) shutdown(timeout time.Duration) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	deadline := time.Now().Add(timeout)
+	for _, s := range d.sockets {
+		s.close()
+	}
+	d.sockets = make(map[string]*socket)
+	drained := d.inflight.drain(time.Until(deadline))
+	if drained {
+		// the last attempts share the drain timeout with the in-flight messages
+		drained = d.retries.flush(deadline)
+		d.retries.close()
+		for _, ns := range d.namespaces {
+			ns.close()
+		}
+		d.namespaces = make(map[string]*namespace)
+	}
+	return drained
+}
+
+func nsName(path string) string {
+	if path == "" {
+		return "in current network namespace"
+	}
+	return "in network namespace " + path
+}
+
+// serveDryRun reports the global dry-run mode, a POST request with the enabled parameter changes it
+func (d *daemon) serveDryRun(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+		if err != nil {
+			http.Error(w, "invalid value for parameter enabled", http.StatusBadRequest)
+			return
+		}
+		setDryRun(d.logger, enabled)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintf(w, "dry-run: %t\n", dryRunEnabled.Load())
+}
+
+// serveCircuitBreaker reports the state of the circuit breaker, a POST request resets it
+func (d *daemon) serveCircuitBreaker(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		breaker.reset()
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintf(w, "circuit-breaker open: %t\n", breaker.isOpen())
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log"
+	"testing"
+	"time"
+)
+
+func TestDaemonAlive(t *testing.T) {
+	d := newDaemon(t.Context(), log.Default(), nil)
+	up, down := &socket{}, &socket{}
+	up.up.Store(true)
+	up.beat()
+	down.beat()
+	d.sockets = map[string]*socket{"up": up, "down": down}
+	// a subscription which is down keeps the daemon alive as long as its supervisor beats
+	if !d.alive(time.Minute) {
+		t.Errorf("alive() = false with beating supervisors")
+	}
+	down.heartbeat.Store(time.Now().Add(-2 * time.Minute).UnixNano())
+	if d.alive(time.Minute) {
+		t.Errorf("alive() = true with a stuck supervisor")
+	}
+}
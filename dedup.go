@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	conntrack "github.com/florianl/go-conntrack"
+)
+
+const defaultDedupSize = 4096
+
+type dedupConfig struct {
+	Window time.Duration `yaml:"window"`
+	Size   int           `yaml:"size"`
+}
+
+// dedupCache remembers recently deleted connections so repeated packets of the same flow do not trigger
+// another deletion within the window, the least recently deleted connections are evicted when it is full
+type dedupCache = lruCache[struct{}]
+
+func newDedupCache(window time.Duration, size int) *dedupCache {
+	if size <= 0 {
+		size = defaultDedupSize
+	}
+	return newLRUCache[struct{}](window, size)
+}
+
+// conKey identifies a connection by its original tuple and zone
+func conKey(family conntrack.Family, con conntrack.Con) string {
+	key := fmt.Sprintf("%d", family)
+	if t := con.Origin; t != nil {
+		if t.Src != nil {
+			key += " " + t.Src.String()
+		}
+		if t.Dst != nil {
+			key += " " + t.Dst.String()
+		}
+		if p := t.Proto; p != nil {
+			for _, v := range []*uint8{p.Number, p.IcmpType, p.IcmpCode, p.Icmpv6Type, p.Icmpv6Code} {
+				if v != nil {
+					key += fmt.Sprintf(" %d", *v)
+				}
+			}
+			for _, v := range []*uint16{p.SrcPort, p.DstPort, p.IcmpID, p.Icmpv6ID} {
+				if v != nil {
+					key += fmt.Sprintf(" %d", *v)
+				}
+			}
+		}
+	}
+	if zone, ok := packetZone(&packet{con: con}); ok {
+		key += fmt.Sprintf(" zone=%d", zone)
+	}
+	return key
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
+	"net"
+	"slices"
+	"time"
 
 	conntrack "github.com/florianl/go-conntrack"
 	"github.com/google/gopacket"
@@ -28,94 +32,395 @@ func addIPv4IPTuple(con *conntrack.Con, pkt gopacket.Packet) {
 	}
 }
 
-func addL4Ports(con *conntrack.Con, srcPort, dstPort uint16, proto uint8) {
-	con.Origin.Proto = &conntrack.ProtoTuple{
-		Number:  &proto,
-		SrcPort: &srcPort,
-		DstPort: &dstPort,
+// ctinfo values, packets in reply direction have IP_CT_ESTABLISHED_REPLY or IP_CT_RELATED_REPLY
+const (
+	ipCtEstablished      = 0
+	ipCtRelated          = 1
+	ipCtNew              = 2
+	ipCtEstablishedReply = 3
+	ipCtRelatedReply     = 4
+)
+
+// NFLOG hooks at which the packet was not translated by NAT yet
+const (
+	hookPrerouting = 0
+	hookLocalOut   = 3
+)
+
+// echoReplies maps the ICMP and ICMPv6 echo types to the type of the opposite direction
+var echoReplies = map[uint8]map[uint8]uint8{
+	1: {
+		layers.ICMPv4TypeEchoRequest: layers.ICMPv4TypeEchoReply,
+		layers.ICMPv4TypeEchoReply:   layers.ICMPv4TypeEchoRequest,
+	},
+	58: {
+		layers.ICMPv6TypeEchoRequest: layers.ICMPv6TypeEchoReply,
+		layers.ICMPv6TypeEchoReply:   layers.ICMPv6TypeEchoRequest,
+	},
+}
+
+// invertTuple returns the tuple of the opposite direction
+func invertTuple(t *conntrack.IPTuple) *conntrack.IPTuple {
+	inv := &conntrack.IPTuple{Src: t.Dst, Dst: t.Src, Zone: t.Zone}
+	if p := t.Proto; p != nil {
+		inv.Proto = &conntrack.ProtoTuple{
+			Number:     p.Number,
+			SrcPort:    p.DstPort,
+			DstPort:    p.SrcPort,
+			IcmpID:     p.IcmpID,
+			IcmpCode:   p.IcmpCode,
+			Icmpv6ID:   p.Icmpv6ID,
+			Icmpv6Code: p.Icmpv6Code,
+		}
+		if p.IcmpType != nil {
+			icmpType := echoReplies[1][*p.IcmpType]
+			inv.Proto.IcmpType = &icmpType
+		}
+		if p.Icmpv6Type != nil {
+			icmpType := echoReplies[58][*p.Icmpv6Type]
+			inv.Proto.Icmpv6Type = &icmpType
+		}
 	}
+	return inv
 }
 
-func extractConFromPayload(data []byte) (conntrack.Con, error) {
-	var con conntrack.Con
-	version := data[0] >> 4
-	if version == 4 {
-		pkt := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.NoCopy)
-		addIPv4IPTuple(&con, pkt)
-		if icmpLayer := pkt.Layer(layers.LayerTypeICMPv4); icmpLayer != nil {
+// payloadCandidates uses the ctinfo and the NFLOG hook to decide how the tuple of a packet decoded from its payload
+// relates to the conntrack entry. A reply direction packet carries the reply tuple and after NAT the packet carries
+// the inverted tuple of the opposite direction. It returns the connection used for matching, with the original
+// tuple as far as known, and the candidates to delete in order.
+func payloadCandidates(con conntrack.Con, ctInfo uint32, hook *uint8) (conntrack.Con, []conntrack.Con) {
+	wire := con.Origin
+	inv := invertTuple(wire)
+	preNAT := hook == nil || *hook == hookPrerouting || *hook == hookLocalOut
+	switch {
+	case ctInfo == ipCtEstablishedReply || ctInfo == ipCtRelatedReply:
+		match := conntrack.Con{Origin: inv}
+		if preNAT {
+			return match, []conntrack.Con{{Reply: wire}, {Origin: inv}}
+		}
+		return match, []conntrack.Con{{Origin: inv}, {Reply: wire}}
+	case ctInfo <= ipCtNew:
+		if preNAT {
+			return con, []conntrack.Con{{Origin: wire}, {Reply: inv}}
+		}
+		return con, []conntrack.Con{{Reply: inv}, {Origin: wire}}
+	}
+	// the direction is unknown
+	return con, []conntrack.Con{{Origin: wire}, {Reply: wire}}
+}
 
-			icmp, _ := icmpLayer.(*layers.ICMPv4)
-			typeCode := icmp.TypeCode
-			icmpType := typeCode.Type()
-			icmpCode := typeCode.Code()
+// decodedProtocols are the protocols whose tuples are decoded with ports, identifiers or keys
+var decodedProtocols = map[uint8]bool{1: true, 6: true, 17: true, 33: true, 47: true, 58: true, 132: true, 136: true}
 
-			if icmpType != 8 || icmpCode != 0 {
-				return con, fmt.Errorf("ignoring non-echo-request ICMP packets")
-			}
+// addTransport adds the ports of TCP, UDP, SCTP, DCCP and UDP-Lite headers, the identifier of ICMP echo messages,
+// the keys of GRE headers and only the protocol number for the generic protocols. The headers are decoded by hand as
+// gopacket does not decode the upper layer of IP fragments.
+func addTransport(tuple *conntrack.IPTuple, proto uint8, l4 []byte, generic map[uint8]bool) error {
+	tuple.Proto = &conntrack.ProtoTuple{Number: &proto}
+	switch proto {
+	case 1, 58:
+		if len(l4) < 8 {
+			return fmt.Errorf("could not decode %s header", protocolName(proto))
+		}
+		icmpType, icmpCode, id := l4[0], l4[1], binary.BigEndian.Uint16(l4[4:6])
+		if _, ok := echoReplies[proto][icmpType]; !ok || icmpCode != 0 {
+			return fmt.Errorf("ignoring %s packets which are neither echo nor error messages", protocolName(proto))
+		}
+		if proto == 1 {
+			tuple.Proto.IcmpType, tuple.Proto.IcmpCode, tuple.Proto.IcmpID = &icmpType, &icmpCode, &id
+		} else {
+			tuple.Proto.Icmpv6Type, tuple.Proto.Icmpv6Code, tuple.Proto.Icmpv6ID = &icmpType, &icmpCode, &id
+		}
+	case 6, 17, 33, 132, 136:
+		if len(l4) < 4 {
+			return fmt.Errorf("could not decode %s ports", protocolName(proto))
+		}
+		srcPort, dstPort := binary.BigEndian.Uint16(l4[0:2]), binary.BigEndian.Uint16(l4[2:4])
+		tuple.Proto.SrcPort, tuple.Proto.DstPort = &srcPort, &dstPort
+	case 47:
+		return addGREKeys(tuple.Proto, l4)
+	default:
+		if !generic[proto] {
+			return fmt.Errorf("ignoring %s packet", protocolName(proto))
+		}
+	}
+	return nil
+}
+
+// fragment identifies the datagram an IP fragment belongs to
+type fragment struct {
+	id    uint32
+	first bool
+	// proto is the next header of the fragment header, unlike the upper layer protocol it is the same in all
+	// fragments of a datagram
+	proto uint8
+}
+
+// ipv4Fragment returns the fragment of an IPv4 packet or nil if the packet is not fragmented
+func ipv4Fragment(id uint16, moreFragments bool, offset uint16, proto uint8) *fragment {
+	if !moreFragments && offset == 0 {
+		return nil
+	}
+	return &fragment{id: uint32(id), first: offset == 0, proto: proto}
+}
+
+// transportPayload returns the upper layer protocol number, the payload and the fragment of the outer IP header
+func transportPayload(pkt gopacket.Packet) (uint8, []byte, *fragment) {
+	switch ip := pkt.NetworkLayer().(type) {
+	case *layers.IPv4:
+		return uint8(ip.Protocol), ip.Payload, ipv4Fragment(ip.Id, ip.Flags&layers.IPv4MoreFragments != 0, ip.FragOffset, uint8(ip.Protocol))
+	case *layers.IPv6:
+		// gopacket strips the hop-by-hop options from the payload but keeps them as next header
+		if ip.HopByHop != nil {
+			return ipv6Payload(uint8(ip.HopByHop.NextHeader), ip.Payload)
+		}
+		return ipv6Payload(uint8(ip.NextHeader), ip.Payload)
+	}
+	return 0, nil, nil
+}
+
+// ipv6FragmentHeader is the IPv6 extension header of fragmented packets
+const ipv6FragmentHeader = 44
 
-			var protoNumber uint8 = 1
-			con.Origin.Proto = &conntrack.ProtoTuple{
-				Number:   &protoNumber,
-				IcmpType: &icmpType,
-				IcmpCode: &icmpCode,
-				IcmpID:   &icmp.Id,
+// ipv6Payload skips the IPv6 extension headers and returns the upper layer protocol number, the payload and the
+// fragment of the packet
+func ipv6Payload(proto uint8, data []byte) (uint8, []byte, *fragment) {
+	proto, data = skipIPv6Extensions(proto, data)
+	if proto != ipv6FragmentHeader || len(data) < 8 {
+		return proto, data, nil
+	}
+	offset, moreFragments := binary.BigEndian.Uint16(data[2:4])>>3, data[3]&1 != 0
+	if !moreFragments && offset == 0 {
+		proto, data = skipIPv6Extensions(data[0], data[8:])
+		return proto, data, nil
+	}
+	frag := &fragment{id: binary.BigEndian.Uint32(data[4:8]), first: offset == 0, proto: data[0]}
+	if !frag.first {
+		// the extension headers behind the fragment header are only part of the first fragment
+		return data[0], data[8:], frag
+	}
+	proto, data = skipIPv6Extensions(data[0], data[8:])
+	return proto, data, frag
+}
+
+// skipIPv6Extensions skips the IPv6 extension headers in front of the upper layer header
+func skipIPv6Extensions(proto uint8, data []byte) (uint8, []byte) {
+	for ipv6ExtensionHeaders[proto] && len(data) >= 8 && len(data) >= (int(data[1])+1)*8 {
+		proto, data = data[0], data[(int(data[1])+1)*8:]
+	}
+	return proto, data
+}
+
+// pptpVersion is the GRE version of the enhanced GRE header used by PPTP
+const pptpVersion = 1
+
+// addGREKeys adds the keys conntrack uses for GRE, which are 0 except for PPTP. The enhanced GRE header of PPTP only
+// carries the call ID of the receiver which is the destination key, the source key is left unset and has to be
+// looked up in the conntrack table.
+func addGREKeys(p *conntrack.ProtoTuple, gre []byte) error {
+	if len(gre) < 4 {
+		return fmt.Errorf("could not decode GRE header")
+	}
+	if gre[1]&0x07 != pptpVersion {
+		var key uint16
+		p.SrcPort, p.DstPort = &key, &key
+		return nil
+	}
+	// the key field of the enhanced GRE header holds the payload length and the call ID
+	if gre[0]&0x20 == 0 || len(gre) < 8 {
+		return fmt.Errorf("could not decode PPTP GRE header")
+	}
+	callID := binary.BigEndian.Uint16(gre[6:8])
+	p.DstPort = &callID
+	return nil
+}
+
+// needsKeyLookup reports whether the source key of a PPTP GRE tuple is unknown
+func needsKeyLookup(con conntrack.Con) bool {
+	p := originProto(con)
+	return p != nil && p.Number != nil && *p.Number == 47 && p.SrcPort == nil
+}
+
+const (
+	greKeyWindow    = 10 * time.Second
+	greKeyCacheSize = 1024
+)
+
+// greKeyCache remembers the conntrack entries found for PPTP call IDs so that not every logged GRE packet dumps the
+// conntrack table, an entry without tuples records that none was found
+type greKeyCache = lruCache[conntrack.Con]
+
+func newGREKeyCache() *greKeyCache {
+	return newLRUCache[conntrack.Con](greKeyWindow, greKeyCacheSize)
+}
+
+// lookupGREKeys returns the conntrack entry of a PPTP GRE tuple with unknown source key, the tuple may match the
+// original or the reply tuple of the entry. The results are cached under the given key prefix.
+func lookupGREKeys(nfct *conntrack.Nfct, cache *greKeyCache, prefix string, family conntrack.Family, con conntrack.Con) (conntrack.Con, error) {
+	wire := con.Origin
+	key := fmt.Sprintf("%s %d %s %s %d", prefix, family, wire.Src, wire.Dst, *wire.Proto.DstPort)
+	now := time.Now()
+	if entry, ok := cache.get(key, now); ok {
+		if entry.Origin == nil {
+			return con, fmt.Errorf("no conntrack entry for GRE call ID %d", *wire.Proto.DstPort)
+		}
+		return entry, nil
+	}
+	entries, err := nfct.Dump(conntrack.Conntrack, family)
+	if err != nil {
+		return con, fmt.Errorf("could not dump conntrack table: %v", err)
+	}
+	for _, entry := range entries {
+		for _, tuple := range []*conntrack.IPTuple{entry.Origin, entry.Reply} {
+			if tuple == nil || tuple.Proto == nil || tuple.Proto.Number == nil || *tuple.Proto.Number != 47 {
+				continue
 			}
+			if tuple.Src == nil || tuple.Dst == nil || tuple.Proto.DstPort == nil {
+				continue
+			}
+			if tuple.Src.Equal(*wire.Src) && tuple.Dst.Equal(*wire.Dst) && *tuple.Proto.DstPort == *wire.Proto.DstPort {
+				found := conntrack.Con{Origin: entry.Origin, Reply: entry.Reply, Zone: entry.Zone}
+				cache.add(key, found, now)
+				return found, nil
+			}
+		}
+	}
+	cache.add(key, conntrack.Con{}, now)
+	return con, fmt.Errorf("no conntrack entry for GRE call ID %d", *wire.Proto.DstPort)
+}
+
+// payloadInfo describes how the tuple of a packet was decoded from its payload
+type payloadInfo struct {
+	// embedded is set for the tuple of the packet embedded in an ICMP error message
+	embedded bool
+	// fragment is set for IP fragments, the tuple of non-first fragments has no ports
+	fragment *fragment
+}
 
-			return con, nil
+// extractConFromPayload decodes the tuple of a packet, for ICMP error messages it decodes the tuple of the embedded
+// packet which caused the error. Packets of the generic protocols and non-first fragments are decoded with the
+// protocol number only.
+func extractConFromPayload(data []byte, generic map[uint8]bool) (con conntrack.Con, info payloadInfo, err error) {
+	if len(data) == 0 {
+		return con, info, fmt.Errorf("empty packet payload")
+	}
+	version := data[0] >> 4
+	if version == 4 {
+		pkt := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.NoCopy)
+		addIPv4IPTuple(&con, pkt)
+		if con.Origin == nil {
+			return con, info, fmt.Errorf("could not decode IPv4 header")
 		}
-		if udpLayer := pkt.Layer(layers.LayerTypeUDP); udpLayer != nil {
-			udp, _ := udpLayer.(*layers.UDP)
-			addL4Ports(&con, uint16(udp.SrcPort), uint16(udp.DstPort), 17)
-			return con, nil
+		proto, l4, frag := transportPayload(pkt)
+		info.fragment = frag
+		if frag != nil && !frag.first {
+			con.Origin.Proto = &conntrack.ProtoTuple{Number: &proto}
+			return con, info, nil
 		}
-		if tcpLayer := pkt.Layer(layers.LayerTypeTCP); tcpLayer != nil {
-			tcp, _ := tcpLayer.(*layers.TCP)
-			addL4Ports(&con, uint16(tcp.SrcPort), uint16(tcp.DstPort), 6)
-			return con, nil
+		if proto == 1 && len(l4) >= 8 && icmpErrorTypes[l4[0]] {
+			// the embedded packet follows the 8 bytes of the ICMP header
+			return extractEmbeddedCon(l4[8:], 4, generic)
 		}
-		return con, fmt.Errorf("could not decode IPv4 packet")
+		if err := addTransport(con.Origin, proto, l4, generic); err != nil {
+			return con, info, fmt.Errorf("could not decode IPv4 packet: %v", err)
+		}
+		return con, info, nil
 	}
 
 	if version == 6 {
 		pkt := gopacket.NewPacket(data, layers.LayerTypeIPv6, gopacket.NoCopy)
 		addIPv6IPTuple(&con, pkt)
-		if icmp6Layer := pkt.Layer(layers.LayerTypeICMPv6); icmp6Layer != nil {
-
-			icmp6, _ := icmp6Layer.(*layers.ICMPv6)
-			typeCode := icmp6.TypeCode
-			icmpType := typeCode.Type()
-			icmpCode := typeCode.Code()
-
-			if icmpType != 128 || icmpCode != 0 {
-				return con, fmt.Errorf("ignoring non-echo-request ICMPv6 packets")
-			}
+		if con.Origin == nil {
+			return con, info, fmt.Errorf("could not decode IPv6 header")
+		}
+		proto, l4, frag := transportPayload(pkt)
+		info.fragment = frag
+		if frag != nil && !frag.first {
+			con.Origin.Proto = &conntrack.ProtoTuple{Number: &proto}
+			return con, info, nil
+		}
+		if proto == 58 && len(l4) >= 8 && icmpv6ErrorTypes[l4[0]] {
+			// the embedded packet follows the 4 bytes of the type specific header
+			return extractEmbeddedCon(l4[8:], 6, generic)
+		}
+		if err := addTransport(con.Origin, proto, l4, generic); err != nil {
+			return con, info, fmt.Errorf("could not decode IPv6 packet: %v", err)
+		}
+		return con, info, nil
+	}
+	return con, info, fmt.Errorf("could not decode packet (non-IPv4/IPv6)")
+}
 
-			if echoLayer := pkt.Layer(layers.LayerTypeICMPv6Echo); echoLayer != nil {
+// ICMP error messages which embed the packet that caused the error
+var (
+	icmpErrorTypes = map[uint8]bool{
+		layers.ICMPv4TypeDestinationUnreachable: true,
+		layers.ICMPv4TypeSourceQuench:           true,
+		layers.ICMPv4TypeRedirect:               true,
+		layers.ICMPv4TypeTimeExceeded:           true,
+		layers.ICMPv4TypeParameterProblem:       true,
+	}
+	icmpv6ErrorTypes = map[uint8]bool{
+		layers.ICMPv6TypeDestinationUnreachable: true,
+		layers.ICMPv6TypePacketTooBig:           true,
+		layers.ICMPv6TypeTimeExceeded:           true,
+		layers.ICMPv6TypeParameterProblem:       true,
+	}
+)
 
-				echo, _ := echoLayer.(*layers.ICMPv6Echo)
+// IPv6 extension headers which are skipped to find the upper layer protocol, fragment headers are handled separately
+var ipv6ExtensionHeaders = map[uint8]bool{
+	0:  true, // hop-by-hop options
+	43: true, // routing
+	60: true, // destination options
+}
 
-				var protoNumber uint8 = 58
-				con.Origin.Proto = &conntrack.ProtoTuple{
-					Number:     &protoNumber,
-					Icmpv6Type: &icmpType,
-					Icmpv6Code: &icmpCode,
-					Icmpv6ID:   &echo.Identifier,
-				}
-				return con, nil
-			}
-			return con, fmt.Errorf("could not decode ICMPv6 packet")
-		}
-		if udpLayer := pkt.Layer(layers.LayerTypeUDP); udpLayer != nil {
-			udp, _ := udpLayer.(*layers.UDP)
-			addL4Ports(&con, uint16(udp.SrcPort), uint16(udp.DstPort), 17)
-			return con, nil
-		}
-		if tcpLayer := pkt.Layer(layers.LayerTypeTCP); tcpLayer != nil {
-			tcp, _ := tcpLayer.(*layers.TCP)
-			addL4Ports(&con, uint16(tcp.SrcPort), uint16(tcp.DstPort), 6)
-			return con, nil
+// extractEmbeddedCon decodes the tuple of the packet embedded in an ICMP error message, only the IP header and the
+// first 8 bytes of the upper layer are guaranteed to be present so the headers are decoded by hand
+func extractEmbeddedCon(data []byte, version int, generic map[uint8]bool) (conntrack.Con, payloadInfo, error) {
+	var con conntrack.Con
+	var proto uint8
+	var l4 []byte
+	var frag *fragment
+	info := payloadInfo{embedded: true}
+	tuple := &conntrack.IPTuple{}
+	switch {
+	case version == 4 && len(data) >= 20 && data[0]>>4 == 4:
+		ihl := int(data[0]&0x0f) * 4
+		if ihl < 20 || len(data) < ihl {
+			return con, info, fmt.Errorf("could not decode embedded IPv4 header")
 		}
-		return con, fmt.Errorf("could not decode IPv6 packet")
+		flagsOffset := binary.BigEndian.Uint16(data[6:8])
+		frag = ipv4Fragment(binary.BigEndian.Uint16(data[4:6]), flagsOffset&0x2000 != 0, flagsOffset&0x1fff, data[9])
+		src, dst := net.IP(slices.Clone(data[12:16])), net.IP(slices.Clone(data[16:20]))
+		tuple.Src, tuple.Dst = &src, &dst
+		proto = data[9]
+		l4 = data[ihl:]
+	case version == 6 && len(data) >= 40 && data[0]>>4 == 6:
+		src, dst := net.IP(slices.Clone(data[8:24])), net.IP(slices.Clone(data[24:40]))
+		tuple.Src, tuple.Dst = &src, &dst
+		proto, l4, frag = ipv6Payload(data[6], data[40:])
+	default:
+		return con, info, fmt.Errorf("could not decode embedded IPv%d header", version)
+	}
+	if frag != nil && !frag.first {
+		return con, info, fmt.Errorf("ignoring embedded non-first IPv%d fragment", version)
+	}
+	con.Origin = tuple
+	if err := addTransport(tuple, proto, l4, generic); err != nil {
+		return con, info, fmt.Errorf("could not decode embedded packet: %v", err)
+	}
+	return con, info, nil
+}
+
+// embeddedCtInfo returns the ctinfo of the packet embedded in an ICMP error message, it travelled in the opposite
+// direction of the error message
+func embeddedCtInfo(ctInfo uint32) uint32 {
+	switch ctInfo {
+	case ipCtRelated:
+		return ipCtEstablishedReply
+	case ipCtRelatedReply:
+		return ipCtEstablished
 	}
-	return con, fmt.Errorf("could not decode packet (non-IPv4/IPv6)")
+	return ctInfo
 }
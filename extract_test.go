@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	conntrack "github.com/florianl/go-conntrack"
+	"github.com/google/gopacket/layers"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("invalid test packet: %v", err)
+	}
+	return data
+}
+
+func TestExtractConFromPayloadProtocols(t *testing.T) {
+	tests := []struct {
+		name    string
+		packet  string
+		generic map[uint8]bool
+		want    string
+		// callID is the destination key of PPTP packets, whose source key has to be looked up
+		callID uint16
+		err    string
+	}{
+		{
+			name:   "SCTP INIT",
+			packet: "450000341234000040847bdbc0000201c633640213880f1c000000000000000001000014deadbeef00010000000a000a00000001",
+			want:   "orig=sctp:192.0.2.1:5000->198.51.100.2:3868",
+		},
+		{
+			name:   "DCCP request over IPv6",
+			packet: "600000000014214020010db800000000000000000000000120010db80000000000000000000000029c40138904000000010000000000000100000000",
+			want:   "orig=dccp:[2001:db8::1]:40000->[2001:db8::2]:5001",
+		},
+		{
+			name:   "UDP-Lite",
+			packet: "450000201234000040887bebc0000201c633640204d2138c0008000072747021",
+			want:   "orig=udplite:192.0.2.1:1234->198.51.100.2:5004",
+		},
+		{
+			name:   "GRE",
+			packet: "4500003412340000402f7c30c0000201c6336402000008004500001c00000000400166df0a0000010a0000020800f7ff00000000",
+			want:   "orig=gre:192.0.2.1:0->198.51.100.2:0",
+		},
+		{
+			name:   "GRE with key over IPv6",
+			packet: "6000000000242f4020010db800000000000000000000000120010db800000000000000000000000220000800000100014500001c00000000400166df0a0000010a0000020800f7ff00000000",
+			want:   "orig=gre:[2001:db8::1]:0->[2001:db8::2]:0",
+		},
+		{
+			name:   "PPTP data",
+			packet: "4500002512340000402f7c3fc0000201c63364023001880b000504d200000007ff03002145",
+			want:   "orig=gre:192.0.2.1->198.51.100.2",
+			callID: 1234,
+		},
+		{
+			name:   "PPTP acknowledgement",
+			packet: "4500002012340000402f7c44c0000201c63364022081880b0000162e00000007",
+			want:   "orig=gre:192.0.2.1->198.51.100.2",
+			callID: 5678,
+		},
+		{
+			name:   "truncated SCTP",
+			packet: "450000161234000040847bf9c0000201c63364021388",
+			err:    "could not decode sctp ports",
+		},
+		{
+			name:   "truncated GRE",
+			packet: "4500001612340000402f7c4ec0000201c63364020000",
+			err:    "could not decode GRE header",
+		},
+		{
+			name:   "PPTP without key",
+			packet: "4500001c12340000402f7c48c0000201c63364020001880b00050000",
+			err:    "could not decode PPTP GRE header",
+		},
+		{
+			name:   "ESP",
+			packet: "4500001c12340000403299c4c0000201c63364020000100100000001",
+			err:    "ignoring esp packet",
+		},
+		{
+			name:    "ESP as generic protocol",
+			packet:  "4500001c12340000403299c4c0000201c63364020000100100000001",
+			generic: map[uint8]bool{50: true},
+			want:    "orig=esp:192.0.2.1->198.51.100.2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			con, info, err := extractConFromPayload(mustDecodeHex(t, tt.packet), tt.generic)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("extractConFromPayload() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extractConFromPayload() failed: %v", err)
+			}
+			if got := formatCon(con); got != tt.want {
+				t.Errorf("extractConFromPayload() = %s, want %s", got, tt.want)
+			}
+			if info.embedded || info.fragment != nil {
+				t.Errorf("extractConFromPayload() info = %+v, want none", info)
+			}
+			if needsKeyLookup(con) != (tt.callID != 0) {
+				t.Errorf("needsKeyLookup() = %v, want %v", needsKeyLookup(con), tt.callID != 0)
+			}
+			if tt.callID != 0 && *con.Origin.Proto.DstPort != tt.callID {
+				t.Errorf("PPTP call ID = %d, want %d", *con.Origin.Proto.DstPort, tt.callID)
+			}
+		})
+	}
+}
+
+func TestLookupGREKeysCached(t *testing.T) {
+	src, dst := net.ParseIP("192.0.2.1").To4(), net.ParseIP("198.51.100.2").To4()
+	proto := uint8(47)
+	callID, peerID := uint16(1234), uint16(5678)
+	wire := conntrack.Con{Origin: &conntrack.IPTuple{Src: &src, Dst: &dst, Proto: &conntrack.ProtoTuple{Number: &proto, DstPort: &callID}}}
+	entry := conntrack.Con{Origin: &conntrack.IPTuple{Src: &src, Dst: &dst, Proto: &conntrack.ProtoTuple{Number: &proto, SrcPort: &peerID, DstPort: &callID}}}
+
+	// cached results do not touch the conntrack table
+	cache := newGREKeyCache()
+	cache.add("l1 2 192.0.2.1 198.51.100.2 1234", entry, time.Now())
+	got, err := lookupGREKeys(nil, cache, "l1", conntrack.IPv4, wire)
+	if err != nil {
+		t.Fatalf("lookupGREKeys() failed: %v", err)
+	}
+	if got.Origin.Proto.SrcPort == nil || *got.Origin.Proto.SrcPort != peerID {
+		t.Errorf("lookupGREKeys() = %s, want source key %d", formatCon(got), peerID)
+	}
+
+	cache.add("l2 2 192.0.2.1 198.51.100.2 1234", conntrack.Con{}, time.Now())
+	if _, err := lookupGREKeys(nil, cache, "l2", conntrack.IPv4, wire); err == nil {
+		t.Errorf("lookupGREKeys() with cached miss succeeded")
+	}
+}
+
+func TestExtractConFromPayloadFragments(t *testing.T) {
+	tests := []struct {
+		name     string
+		packet   string
+		want     string
+		fragment *fragment
+		embedded bool
+		err      string
+	}{
+		{
+			name:     "IPv4 first fragment",
+			packet:   "450000281234200040065c65c0000201c63364029c40005000000001000000005002ffff00000000",
+			want:     "orig=tcp:192.0.2.1:40000->198.51.100.2:80",
+			fragment: &fragment{id: 0x1234, first: true, proto: 6},
+		},
+		{
+			name:     "IPv4 later fragment",
+			packet:   "45000024123400b940067bb0c0000201c633640200000000000000000000000000000000",
+			want:     "orig=tcp:192.0.2.1->198.51.100.2",
+			fragment: &fragment{id: 0x1234, proto: 6},
+		},
+		{
+			name:     "IPv6 first fragment",
+			packet:   "6000000000182c4020010db800000000000000000000000120010db800000000000000000000000211000001abcdef0114e90035001000000000000000000000",
+			want:     "orig=udp:[2001:db8::1]:5353->[2001:db8::2]:53",
+			fragment: &fragment{id: 0xabcdef01, first: true, proto: 17},
+		},
+		{
+			name:     "IPv6 later fragment",
+			packet:   "6000000000182c4020010db800000000000000000000000120010db800000000000000000000000211000018abcdef0100000000000000000000000000000000",
+			want:     "orig=udp:2001:db8::1->2001:db8::2",
+			fragment: &fragment{id: 0xabcdef01, proto: 17},
+		},
+		{
+			name:   "IPv6 atomic fragment",
+			packet: "6000000000182c4020010db800000000000000000000000120010db800000000000000000000000211000000abcdef0114e90035001000000000000000000000",
+			want:   "orig=udp:[2001:db8::1]:5353->[2001:db8::2]:53",
+		},
+		{
+			name:   "IPv6 hop-by-hop and destination options",
+			packet: "600000000024004020010db800000000000000000000000120010db80000000000000000000000023c0001040000000006000104000000009c40005000000001000000005002ffff00000000",
+			want:   "orig=tcp:[2001:db8::1]:40000->[2001:db8::2]:80",
+		},
+		{
+			name:     "IPv6 hop-by-hop, routing, destination options and first fragment",
+			packet:   "600000000038004020010db800000000000000000000000120010db80000000000000000000000022b000104000000003c000000000000002c01010c00000000000000000000000011000001abcdef0114e90035001000000000000000000000",
+			want:     "orig=udp:[2001:db8::1]:5353->[2001:db8::2]:53",
+			fragment: &fragment{id: 0xabcdef01, first: true, proto: 17},
+		},
+		{
+			name:     "IPv6 hop-by-hop, routing and later fragment with destination options",
+			packet:   "600000000028004020010db800000000000000000000000120010db80000000000000000000000022b000104000000002c000000000000003c000018abcdef0100000000000000000000000000000000",
+			want:     "orig=60:2001:db8::1->2001:db8::2",
+			fragment: &fragment{id: 0xabcdef01, proto: 60},
+		},
+		{
+			name:     "IPv6 destination options after the fragment header",
+			packet:   "6000000000202c4020010db800000000000000000000000120010db80000000000000000000000023c000001abcdef01110001040000000014e90035001000000000000000000000",
+			want:     "orig=udp:[2001:db8::1]:5353->[2001:db8::2]:53",
+			fragment: &fragment{id: 0xabcdef01, first: true, proto: 60},
+		},
+		{
+			name:     "ICMPv6 error embedding a first fragment with hop-by-hop options",
+			packet:   "6000000000503a4020010db800000000000000000000000220010db80000000000000000000000010100000000000000600000000020004020010db800000000000000000000000220010db80000000000000000000000012c0001040000000011000001abcdef0114e90035001000000000000000000000",
+			want:     "orig=udp:[2001:db8::2]:5353->[2001:db8::1]:53",
+			embedded: true,
+		},
+		{
+			name:   "ICMP error embedding a later fragment",
+			packet: "450000381234000040017c5ac6336402c0000201030400000000000045000024123400b940067bb0c6336402c00002010000000000000000",
+			err:    "ignoring embedded non-first IPv4 fragment",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			con, info, err := extractConFromPayload(mustDecodeHex(t, tt.packet), nil)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("extractConFromPayload() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extractConFromPayload() failed: %v", err)
+			}
+			if got := formatCon(con); got != tt.want {
+				t.Errorf("extractConFromPayload() = %s, want %s", got, tt.want)
+			}
+			if info.embedded != tt.embedded {
+				t.Errorf("extractConFromPayload() embedded = %v, want %v", info.embedded, tt.embedded)
+			}
+			if (info.fragment == nil) != (tt.fragment == nil) || info.fragment != nil && *info.fragment != *tt.fragment {
+				t.Errorf("extractConFromPayload() fragment = %+v, want %+v", info.fragment, tt.fragment)
+			}
+		})
+	}
+}
+
+func TestFragmentKey(t *testing.T) {
+	// the later fragments carry no ports and no extension headers but belong to the same datagram as the first fragment
+	tests := []struct {
+		name         string
+		first, later string
+	}{
+		{
+			name:  "IPv4",
+			first: "450000281234200040065c65c0000201c63364029c40005000000001000000005002ffff00000000",
+			later: "45000024123400b940067bb0c0000201c633640200000000000000000000000000000000",
+		},
+		{
+			name:  "IPv6",
+			first: "6000000000182c4020010db800000000000000000000000120010db800000000000000000000000211000001abcdef0114e90035001000000000000000000000",
+			later: "6000000000182c4020010db800000000000000000000000120010db800000000000000000000000211000018abcdef0100000000000000000000000000000000",
+		},
+		{
+			name:  "IPv6 with destination options after the fragment header",
+			first: "6000000000202c4020010db800000000000000000000000120010db80000000000000000000000023c000001abcdef01110001040000000014e90035001000000000000000000000",
+			later: "6000000000182c4020010db800000000000000000000000120010db80000000000000000000000023c000018abcdef0100000000000000000000000000000000",
+		},
+	}
+	for _, tt := range tests {
+		var keys []string
+		for _, packet := range []string{tt.first, tt.later} {
+			data := mustDecodeHex(t, packet)
+			con, info, err := extractConFromPayload(data, nil)
+			if err != nil || info.fragment == nil {
+				t.Fatalf("%s: extractConFromPayload() = %+v, %v, want a fragment", tt.name, info, err)
+			}
+			family := conntrack.IPv4
+			if data[0]>>4 == 6 {
+				family = conntrack.IPv6
+			}
+			keys = append(keys, fragmentKey(family, con.Origin, info.fragment))
+		}
+		if keys[0] != keys[1] {
+			t.Errorf("%s: fragmentKey() = %q and %q, want the same key", tt.name, keys[0], keys[1])
+		}
+	}
+}
+
+func TestAddTransportEchoTypes(t *testing.T) {
+	tests := []struct {
+		proto    uint8
+		icmpType uint8
+		ok       bool
+	}{
+		{1, 8, true},
+		{1, 0, true},
+		{1, 128, false},
+		{58, 128, true},
+		{58, 129, true},
+		{58, 8, false},
+		{58, 0, false},
+	}
+	for _, tt := range tests {
+		l4 := []byte{tt.icmpType, 0, 0, 0, 0x12, 0x34, 0, 1}
+		err := addTransport(&conntrack.IPTuple{}, tt.proto, l4, nil)
+		if (err == nil) != tt.ok {
+			t.Errorf("addTransport(proto %d, type %d) error = %v, want ok %v", tt.proto, tt.icmpType, err, tt.ok)
+		}
+	}
+}
+
+func TestPayloadCandidates(t *testing.T) {
+	const (
+		wire = "tcp:10.0.0.1:40000->192.0.2.1:22"
+		inv  = "tcp:192.0.2.1:22->10.0.0.1:40000"
+	)
+	hook := func(h uint8) *uint8 { return &h }
+	tests := []struct {
+		name   string
+		ctInfo uint32
+		hook   *uint8
+		match  string
+		want   []string
+	}{
+		{"established at prerouting", ipCtEstablished, hook(hookPrerouting), "orig=" + wire, []string{"orig=" + wire, "reply=" + inv}},
+		{"new at output", ipCtNew, hook(hookLocalOut), "orig=" + wire, []string{"orig=" + wire, "reply=" + inv}},
+		{"new without hook", ipCtNew, nil, "orig=" + wire, []string{"orig=" + wire, "reply=" + inv}},
+		{"related at input", ipCtRelated, hook(1), "orig=" + wire, []string{"reply=" + inv, "orig=" + wire}},
+		{"established at forward", ipCtEstablished, hook(2), "orig=" + wire, []string{"reply=" + inv, "orig=" + wire}},
+		{"new at postrouting", ipCtNew, hook(4), "orig=" + wire, []string{"reply=" + inv, "orig=" + wire}},
+		{"established reply at prerouting", ipCtEstablishedReply, hook(hookPrerouting), "orig=" + inv, []string{"reply=" + wire, "orig=" + inv}},
+		{"related reply at output", ipCtRelatedReply, hook(hookLocalOut), "orig=" + inv, []string{"reply=" + wire, "orig=" + inv}},
+		{"established reply at input", ipCtEstablishedReply, hook(1), "orig=" + inv, []string{"orig=" + inv, "reply=" + wire}},
+		{"related reply at postrouting", ipCtRelatedReply, hook(4), "orig=" + inv, []string{"orig=" + inv, "reply=" + wire}},
+		{"unknown at prerouting", ^uint32(0), hook(hookPrerouting), "orig=" + wire, []string{"orig=" + wire, "reply=" + wire}},
+		{"unknown at forward", ^uint32(0), hook(2), "orig=" + wire, []string{"orig=" + wire, "reply=" + wire}},
+	}
+	src, dst := net.ParseIP("10.0.0.1").To4(), net.ParseIP("192.0.2.1").To4()
+	proto := uint8(6)
+	sport, dport := uint16(40000), uint16(22)
+	con := conntrack.Con{Origin: &conntrack.IPTuple{Src: &src, Dst: &dst, Proto: &conntrack.ProtoTuple{Number: &proto, SrcPort: &sport, DstPort: &dport}}}
+	for _, tt := range tests {
+		match, candidates := payloadCandidates(con, tt.ctInfo, tt.hook)
+		if got := formatCon(match); got != tt.match {
+			t.Errorf("%s: payloadCandidates() matches %s, want %s", tt.name, got, tt.match)
+		}
+		var got []string
+		for _, c := range candidates {
+			got = append(got, formatCon(c))
+		}
+		if strings.Join(got, ", ") != strings.Join(tt.want, ", ") {
+			t.Errorf("%s: payloadCandidates() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestInvertTupleEcho(t *testing.T) {
+	tests := []struct {
+		proto    uint8
+		icmpType uint8
+		want     uint8
+	}{
+		{1, layers.ICMPv4TypeEchoReply, layers.ICMPv4TypeEchoRequest},
+		{1, layers.ICMPv4TypeEchoRequest, layers.ICMPv4TypeEchoReply},
+		{58, layers.ICMPv6TypeEchoReply, layers.ICMPv6TypeEchoRequest},
+		{58, layers.ICMPv6TypeEchoRequest, layers.ICMPv6TypeEchoReply},
+	}
+	for _, tt := range tests {
+		id, code := uint16(7), uint8(0)
+		p := &conntrack.ProtoTuple{Number: &tt.proto}
+		if tt.proto == 1 {
+			p.IcmpType, p.IcmpCode, p.IcmpID = &tt.icmpType, &code, &id
+		} else {
+			p.Icmpv6Type, p.Icmpv6Code, p.Icmpv6ID = &tt.icmpType, &code, &id
+		}
+		inv := invertTuple(&conntrack.IPTuple{Proto: p})
+		got := inv.Proto.IcmpType
+		if tt.proto == 58 {
+			got = inv.Proto.Icmpv6Type
+		}
+		if got == nil || *got != tt.want {
+			t.Errorf("invertTuple(proto %d, type %d) type = %v, want %d", tt.proto, tt.icmpType, got, tt.want)
+		}
+	}
+
+	// a reply direction echo reply matches as the echo request of the original direction
+	src, dst := net.ParseIP("192.0.2.1").To4(), net.ParseIP("10.0.0.1").To4()
+	proto, icmpType, code, id := uint8(1), uint8(layers.ICMPv4TypeEchoReply), uint8(0), uint16(7)
+	con := conntrack.Con{Origin: &conntrack.IPTuple{Src: &src, Dst: &dst, Proto: &conntrack.ProtoTuple{Number: &proto, IcmpType: &icmpType, IcmpCode: &code, IcmpID: &id}}}
+	match, _ := payloadCandidates(con, ipCtEstablishedReply, nil)
+	if *match.Origin.Proto.IcmpType != layers.ICMPv4TypeEchoRequest || !match.Origin.Src.Equal(dst) {
+		t.Errorf("payloadCandidates() matches %s type %d, want the echo request from 10.0.0.1", formatCon(match), *match.Origin.Proto.IcmpType)
+	}
+}
+
+func TestEmbeddedCtInfo(t *testing.T) {
+	// the packet embedded in an ICMP error travelled in the opposite direction of the error
+	tests := []struct {
+		ctInfo uint32
+		want   uint32
+	}{
+		{ipCtRelated, ipCtEstablishedReply},
+		{ipCtRelatedReply, ipCtEstablished},
+		{ipCtEstablished, ipCtEstablished},
+		{ipCtNew, ipCtNew},
+		{^uint32(0), ^uint32(0)},
+	}
+	for _, tt := range tests {
+		if got := embeddedCtInfo(tt.ctInfo); got != tt.want {
+			t.Errorf("embeddedCtInfo(%d) = %d, want %d", tt.ctInfo, got, tt.want)
+		}
+	}
+}
+
+func TestExtractEmbeddedGenericProtocol(t *testing.T) {
+	// port unreachable for an ESP packet from 192.0.2.1 to 198.51.100.2
+	data := mustDecodeHex(t, "450000381234000040017c5ac6336402c000020103030000000000004500001c12340000403299c4c0000201c63364020000100100000001")
+	if _, _, err := extractConFromPayload(data, nil); err == nil || !strings.Contains(err.Error(), "ignoring esp packet") {
+		t.Errorf("extractConFromPayload() error = %v, want the embedded ESP packet ignored", err)
+	}
+	con, info, err := extractConFromPayload(data, map[uint8]bool{50: true})
+	if err != nil {
+		t.Fatalf("extractConFromPayload() failed: %v", err)
+	}
+	if got, want := formatCon(con), "orig=esp:192.0.2.1->198.51.100.2"; got != want || !info.embedded {
+		t.Errorf("extractConFromPayload() = %s (embedded %v), want embedded %s", got, info.embedded, want)
+	}
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The filter language matches the packets received by ctrmd, for example:
+//
+//	tcp and dport 443 and src net 10.0.0.0/8 and ctmark 0x10/0xff and zone 3
+//
+// Primitives can be combined with and/&&, or/|| and not/! and grouped with parentheses.
+// Numeric fields can be compared with ==, !=, <, <=, > and >=.
+
+// filterError is a parse error at a position of the filter expression
+type filterError struct {
+	pos int
+	msg string
+}
+
+func (e *filterError) Error() string {
+	return fmt.Sprintf("filter position %d: %s", e.pos+1, e.msg)
+}
+
+type filterNode interface {
+	match(p *packet) bool
+	String() string
+}
+
+type andNode struct{ left, right filterNode }
+
+func (n *andNode) match(p *packet) bool { return n.left.match(p) && n.right.match(p) }
+func (n *andNode) String() string       { return fmt.Sprintf("(%s and %s)", n.left, n.right) }
+
+type orNode struct{ left, right filterNode }
+
+func (n *orNode) match(p *packet) bool { return n.left.match(p) || n.right.match(p) }
+func (n *orNode) String() string       { return fmt.Sprintf("(%s or %s)", n.left, n.right) }
+
+type notNode struct{ node filterNode }
+
+func (n *notNode) match(p *packet) bool { return !n.node.match(p) }
+func (n *notNode) String() string       { return fmt.Sprintf("not %s", n.node) }
+
+// leafNode is a primitive of the filter language
+type leafNode struct {
+	desc string
+	fn   matcher
+}
+
+func (n *leafNode) match(p *packet) bool { return n.fn(p) }
+func (n *leafNode) String() string       { return n.desc }
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenWord
+	tokenString
+	tokenLParen
+	tokenRParen
+	tokenNot
+	tokenAnd
+	tokenOr
+	tokenCompare
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of filter"
+	}
+	return strconv.Quote(t.value)
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("._:/-", r)
+}
+
+func tokenize(expr string) ([]token, error) {
+	var tokens []token
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{tokenLParen, "(", i})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{tokenRParen, ")", i})
+			i++
+		case r == '&' || r == '|':
+			if i+1 >= len(runes) || runes[i+1] != r {
+				return nil, &filterError{i, fmt.Sprintf("unexpected %q, use %c%c", r, r, r)}
+			}
+			kind := tokenAnd
+			if r == '|' {
+				kind = tokenOr
+			}
+			tokens = append(tokens, token{kind, string([]rune{r, r}), i})
+			i += 2
+		case r == '!' || r == '=' || r == '<' || r == '>':
+			if i+1 < len(runes) && runes[i+1] == '=' {
+				tokens = append(tokens, token{tokenCompare, string([]rune{r, '='}), i})
+				i += 2
+				continue
+			}
+			switch r {
+			case '!':
+				tokens = append(tokens, token{tokenNot, "!", i})
+			case '=':
+				return nil, &filterError{i, "unexpected \"=\", use =="}
+			default:
+				tokens = append(tokens, token{tokenCompare, string(r), i})
+			}
+			i++
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end >= len(runes) {
+				return nil, &filterError{i, "unterminated string"}
+			}
+			tokens = append(tokens, token{tokenString, string(runes[i+1 : end]), i})
+			i = end + 1
+		case isWordRune(r):
+			start := i
+			for i < len(runes) && isWordRune(runes[i]) {
+				i++
+			}
+			word := string(runes[start:i])
+			switch strings.ToLower(word) {
+			case "and":
+				tokens = append(tokens, token{tokenAnd, word, start})
+			case "or":
+				tokens = append(tokens, token{tokenOr, word, start})
+			case "not":
+				tokens = append(tokens, token{tokenNot, word, start})
+			default:
+				tokens = append(tokens, token{tokenWord, word, start})
+			}
+		default:
+			return nil, &filterError{i, fmt.Sprintf("unexpected character %q", r)}
+		}
+	}
+	return append(tokens, token{tokenEOF, "", len(runes)}), nil
+}
+
+type filterParser struct {
+	tokens []token
+	pos    int
+}
+
+// parseFilter parses a filter expression
+func parseFilter(expr string) (filterNode, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	fp := &filterParser{tokens: tokens}
+	if fp.peek().kind == tokenEOF {
+		return nil, &filterError{0, "empty filter"}
+	}
+	node, err := fp.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := fp.peek(); t.kind != tokenEOF {
+		return nil, &filterError{t.pos, fmt.Sprintf("unexpected %s", t)}
+	}
+	return node, nil
+}
+
+func (fp *filterParser) peek() token {
+	return fp.tokens[fp.pos]
+}
+
+func (fp *filterParser) next() token {
+	t := fp.tokens[fp.pos]
+	if t.kind != tokenEOF {
+		fp.pos++
+	}
+	return t
+}
+
+func (fp *filterParser) parseOr() (filterNode, error) {
+	left, err := fp.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for fp.peek().kind == tokenOr {
+		fp.next()
+		right, err := fp.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left, right}
+	}
+	return left, nil
+}
+
+func (fp *filterParser) parseAnd() (filterNode, error) {
+	left, err := fp.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for fp.peek().kind == tokenAnd {
+		fp.next()
+		right, err := fp.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left, right}
+	}
+	return left, nil
+}
+
+func (fp *filterParser) parseUnary() (filterNode, error) {
+	t := fp.next()
+	switch t.kind {
+	case tokenNot:
+		node, err := fp.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{node}, nil
+	case tokenLParen:
+		node, err := fp.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := fp.next(); closing.kind != tokenRParen {
+			return nil, &filterError{closing.pos, fmt.Sprintf("expected \")\" but found %s", closing)}
+		}
+		return node, nil
+	case tokenWord:
+		return fp.parsePrimitive(t)
+	}
+	return nil, &filterError{t.pos, fmt.Sprintf("expected a filter primitive but found %s", t)}
+}
+
+// value returns the next token, which has to be a value for the given keyword
+func (fp *filterParser) value(keyword token) (token, error) {
+	t := fp.next()
+	if t.kind != tokenWord && t.kind != tokenString {
+		return t, &filterError{t.pos, fmt.Sprintf("expected a value after %q but found %s", keyword.value, t)}
+	}
+	return t, nil
+}
+
+// compareOp returns the comparison operator in front of a value, == if none is given
+func (fp *filterParser) compareOp() string {
+	if fp.peek().kind == tokenCompare {
+		return fp.next().value
+	}
+	return "=="
+}
+
+func compare(op string, a, b uint64) bool {
+	switch op {
+	case "!=":
+		return a != b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+	return a == b
+}
+
+// opPrefix returns the operator as written in front of a value, equality is implied
+func opPrefix(op string) string {
+	if op == "==" {
+		return ""
+	}
+	return op + " "
+}
+
+// fieldBits are the sizes of the numeric fields
+var fieldBits = map[string]int{
+	"zone": 16,
+	"uid":  32,
+	"gid":  32,
+	"hook": 8,
+}
+
+var hookNumbers = map[string]uint8{
+	"prerouting":  0,
+	"input":       1,
+	"forward":     2,
+	"output":      3,
+	"postrouting": 4,
+}
+
+func (fp *filterParser) parsePrimitive(keyword token) (filterNode, error) {
+	word := strings.ToLower(keyword.value)
+	if number, ok := protocolNumbers[word]; ok {
+		return &leafNode{word, matchProtocols([]uint8{number})}, nil
+	}
+	switch word {
+	case "ip", "ip6", "inet", "inet6":
+		family, _ := parseFamily(word)
+		return &leafNode{word, matchFamily(family)}, nil
+	case "family":
+		t, err := fp.value(keyword)
+		if err != nil {
+			return nil, err
+		}
+		family, err := parseFamily(t.value)
+		if err != nil {
+			return nil, &filterError{t.pos, err.Error()}
+		}
+		return &leafNode{"family " + t.value, matchFamily(family)}, nil
+	case "proto":
+		t, err := fp.value(keyword)
+		if err != nil {
+			return nil, err
+		}
+		number, err := parseProtocol(t.value)
+		if err != nil {
+			return nil, &filterError{t.pos, err.Error()}
+		}
+		return &leafNode{"proto " + t.value, matchProtocols([]uint8{number})}, nil
+	case "src", "dst":
+		t := fp.next()
+		if t.kind != tokenWord {
+			return nil, &filterError{t.pos, fmt.Sprintf("expected host, net or port after %q but found %s", word, t)}
+		}
+		return fp.parseAddressOrPort(word, t)
+	case "host", "net", "port":
+		return fp.parseAddressOrPort("", keyword)
+	case "sport":
+		return fp.parseAddressOrPort("src", token{tokenWord, "port", keyword.pos})
+	case "dport":
+		return fp.parseAddressOrPort("dst", token{tokenWord, "port", keyword.pos})
+	case "mark", "ctmark":
+		t, err := fp.value(keyword)
+		if err != nil {
+			return nil, err
+		}
+		m, err := parseMarkMask(t.value)
+		if err != nil {
+			return nil, &filterError{t.pos, err.Error()}
+		}
+		desc := fmt.Sprintf("%s 0x%x/0x%x", word, m.value, m.mask)
+		if word == "mark" {
+			return &leafNode{desc, matchMark(m)}, nil
+		}
+		return &leafNode{desc, matchCtMark(m)}, nil
+	case "zone", "uid", "gid", "hook":
+		op := fp.compareOp()
+		t, err := fp.value(keyword)
+		if err != nil {
+			return nil, err
+		}
+		var value uint64
+		if number, ok := hookNumbers[strings.ToLower(t.value)]; ok && word == "hook" {
+			value = uint64(number)
+		} else if value, err = strconv.ParseUint(t.value, 0, fieldBits[word]); err != nil {
+			return nil, &filterError{t.pos, fmt.Sprintf("invalid %s %q", word, t.value)}
+		}
+		get := map[string]func(p *packet) (uint64, bool){
+			"zone": packetZone,
+			"uid":  func(p *packet) (uint64, bool) { return optional(p.attr.UID) },
+			"gid":  func(p *packet) (uint64, bool) { return optional(p.attr.GID) },
+			"hook": func(p *packet) (uint64, bool) { return optional(p.attr.Hook) },
+		}[word]
+		return &leafNode{fmt.Sprintf("%s %s%s", word, opPrefix(op), t.value), func(p *packet) bool {
+			v, ok := get(p)
+			return ok && compare(op, v, value)
+		}}, nil
+	case "iif", "oif":
+		t, err := fp.value(keyword)
+		if err != nil {
+			return nil, err
+		}
+		return &leafNode{fmt.Sprintf("%s %s", word, t.value), matchInterface(t.value, word == "oif")}, nil
+	case "vlan":
+		t, err := fp.value(keyword)
+		if err != nil {
+			return nil, err
+		}
+		id, err := strconv.ParseUint(t.value, 0, 12)
+		if err != nil {
+			return nil, &filterError{t.pos, fmt.Sprintf("invalid VLAN ID %q", t.value)}
+		}
+		return &leafNode{"vlan " + t.value, matchVLAN(uint16(id))}, nil
+	case "prefix":
+		t, err := fp.value(keyword)
+		if err != nil {
+			return nil, err
+		}
+		return &leafNode{fmt.Sprintf("prefix %q", t.value), matchPrefix(t.value)}, nil
+	}
+	return nil, &filterError{keyword.pos, fmt.Sprintf("unknown filter primitive %q", keyword.value)}
+}
+
+// parseAddressOrPort parses the host, net and port primitives with an optional src/dst direction
+func (fp *filterParser) parseAddressOrPort(dir string, keyword token) (filterNode, error) {
+	kind := strings.ToLower(keyword.value)
+	prefix := kind
+	if dir != "" {
+		prefix = dir + " " + kind
+	}
+	directions := []bool{dir == "dst"}
+	if dir == "" {
+		directions = []bool{false, true}
+	}
+	switch kind {
+	case "host", "net":
+		t, err := fp.value(keyword)
+		if err != nil {
+			return nil, err
+		}
+		ipNet, err := parseNet(t.value)
+		if err != nil {
+			return nil, &filterError{t.pos, err.Error()}
+		}
+		if kind == "host" && strings.Contains(t.value, "/") {
+			return nil, &filterError{t.pos, fmt.Sprintf("expected an address but found network %q", t.value)}
+		}
+		var matchers []matcher
+		for _, dst := range directions {
+			matchers = append(matchers, matchNets([]*net.IPNet{ipNet}, dst))
+		}
+		return &leafNode{fmt.Sprintf("%s %s", prefix, t.value), matchAny(matchers...)}, nil
+	case "port":
+		op := fp.compareOp()
+		t, err := fp.value(keyword)
+		if err != nil {
+			return nil, err
+		}
+		var matchers []matcher
+		// without a direction != means that neither port has the value, the other comparisons match either port
+		combine := matchAny
+		if op == "!=" {
+			combine = matchAll
+		}
+		if op == "==" {
+			r, err := parsePortRange(t.value)
+			if err != nil {
+				return nil, &filterError{t.pos, err.Error()}
+			}
+			for _, dst := range directions {
+				matchers = append(matchers, matchPorts([]portRange{r}, dst))
+			}
+		} else {
+			port, err := strconv.ParseUint(t.value, 10, 16)
+			if err != nil {
+				return nil, &filterError{t.pos, fmt.Sprintf("invalid port %q", t.value)}
+			}
+			for _, dst := range directions {
+				matchers = append(matchers, matchPortCompare(op, uint16(port), dst))
+			}
+		}
+		return &leafNode{fmt.Sprintf("%s %s%s", prefix, opPrefix(op), t.value), combine(matchers...)}, nil
+	}
+	return nil, &filterError{keyword.pos, fmt.Sprintf("expected host, net or port but found %s", keyword)}
+}
+
+// matchAny returns a matcher which matches if any of the given matchers matches
+func matchAny(matchers ...matcher) matcher {
+	return func(p *packet) bool {
+		for _, m := range matchers {
+			if m(p) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func matchPortCompare(op string, port uint16, dst bool) matcher {
+	return func(p *packet) bool {
+		proto := originProto(p.con)
+		if proto == nil {
+			return false
+		}
+		v := proto.SrcPort
+		if dst {
+			v = proto.DstPort
+		}
+		return v != nil && compare(op, uint64(*v), uint64(port))
+	}
+}
+
+func optional[T uint8 | uint16 | uint32](v *T) (uint64, bool) {
+	if v == nil {
+		return 0, false
+	}
+	return uint64(*v), true
+}
+
+// packetZone returns the conntrack zone of the packet
+func packetZone(p *packet) (uint64, bool) {
+	if p.con.Zone != nil {
+		return uint64(*p.con.Zone), true
+	}
+	if p.con.Origin != nil && p.con.Origin.Zone != nil {
+		return uint64(*p.con.Origin.Zone), true
+	}
+	return 0, false
+}
+
+// usesCtMark reports whether a filter matches on the conntrack mark
+func usesCtMark(node filterNode) bool {
+	switch n := node.(type) {
+	case *andNode:
+		return usesCtMark(n.left) || usesCtMark(n.right)
+	case *orNode:
+		return usesCtMark(n.left) || usesCtMark(n.right)
+	case *notNode:
+		return usesCtMark(n.node)
+	case *leafNode:
+		return strings.HasPrefix(n.desc, "ctmark ")
+	}
+	return false
+}
+
+// compileFilter parses a filter expression into a matcher
+func compileFilter(expr string) (matcher, error) {
+	node, err := parseFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	return node.match, nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	conntrack "github.com/florianl/go-conntrack"
+	nflog "github.com/florianl/go-nflog/v2"
+)
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"tcp", "tcp"},
+		{"proto 132", "proto 132"},
+		{"ip6", "ip6"},
+		{"family inet", "family inet"},
+		{"tcp and dport 443 or zone != 3", "((tcp and dst port 443) or zone != 3)"},
+		{"tcp && (udp || icmp)", "(tcp and (udp or icmp))"},
+		{"not tcp and udp", "(not tcp and udp)"},
+		{"!(tcp or udp)", "not (tcp or udp)"},
+		{"src host 192.0.2.1", "src host 192.0.2.1"},
+		{"dst net 10.0.0.0/8", "dst net 10.0.0.0/8"},
+		{"net 2001:db8::/32", "net 2001:db8::/32"},
+		{"port 8000-8999", "port 8000-8999"},
+		{"sport >= 1024", "src port >= 1024"},
+		{"dst port < 1024", "dst port < 1024"},
+		{"port != 22", "port != 22"},
+		{"mark 16", "mark 0x10/0xffffffff"},
+		{"ctmark 0x10/0xff", "ctmark 0x10/0xff"},
+		{"zone == 3", "zone 3"},
+		{"uid <= 1000 and gid > 0", "(uid <= 1000 and gid > 0)"},
+		{"hook prerouting", "hook prerouting"},
+		{"iif eth0 or oif eth1", "(iif eth0 or oif eth1)"},
+		{`prefix "ct drop"`, `prefix "ct drop"`},
+		{"vlan 100", "vlan 100"},
+	}
+	for _, tt := range tests {
+		node, err := parseFilter(tt.expr)
+		if err != nil {
+			t.Errorf("parseFilter(%q) failed: %v", tt.expr, err)
+			continue
+		}
+		if got := node.String(); got != tt.want {
+			t.Errorf("parseFilter(%q) = %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"", `filter position 1: empty filter`},
+		{"tcp &", `filter position 5: unexpected '&', use &&`},
+		{"tcp and", `filter position 8: expected a filter primitive but found end of filter`},
+		{"(tcp or udp", `filter position 12: expected ")" but found end of filter`},
+		{"tcp udp", `filter position 5: unexpected "udp"`},
+		{"tcp)", `filter position 4: unexpected ")"`},
+		{"port = 22", `filter position 6: unexpected "=", use ==`},
+		{"tcp # udp", `filter position 5: unexpected character '#'`},
+		{`prefix "drop`, `filter position 8: unterminated string`},
+		{"foo", `filter position 1: unknown filter primitive "foo"`},
+		{"src tcp", `filter position 5: expected host, net or port but found "tcp"`},
+		{"src (", `filter position 5: expected host, net or port after "src" but found "("`},
+		{"dport", `filter position 6: expected a value after "port" but found end of filter`},
+		{"port 80-79", `filter position 6: invalid port range "80-79"`},
+		{"port != 80-90", `filter position 9: invalid port "80-90"`},
+		{"host 10.0.0.0/8", `filter position 6: expected an address but found network "10.0.0.0/8"`},
+		{"net 10.0.0.0/33", `filter position 5: invalid network "10.0.0.0/33"`},
+		{"proto foo", `filter position 7: unknown protocol "foo"`},
+		{"family ipx", `filter position 8: unknown family "ipx"`},
+		{"ctmark 0x10/zz", `filter position 8: invalid mask "zz"`},
+		{"zone 70000", `filter position 6: invalid zone "70000"`},
+		{"uid 4294967296", `filter position 5: invalid uid "4294967296"`},
+		{"hook 256", `filter position 6: invalid hook "256"`},
+		{"vlan 4096", `filter position 6: invalid VLAN ID "4096"`},
+	}
+	for _, tt := range tests {
+		_, err := parseFilter(tt.expr)
+		if err == nil {
+			t.Errorf("parseFilter(%q) succeeded, want error %s", tt.expr, tt.want)
+			continue
+		}
+		if got := err.Error(); got != tt.want {
+			t.Errorf("parseFilter(%q) error = %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+}
+
+// testPacket returns a forwarded SSH packet from 10.0.0.1:40000 to 192.0.2.1:22 in zone 3
+func testPacket() *packet {
+	src, dst := net.ParseIP("10.0.0.1").To4(), net.ParseIP("192.0.2.1").To4()
+	proto := uint8(6)
+	sport, dport := uint16(40000), uint16(22)
+	zone := uint16(3)
+	mark, ctMark := uint32(0x10), uint32(0x110)
+	hook := uint8(2)
+	uid, gid := uint32(1000), uint32(100)
+	prefix := "ct drop"
+	return &packet{
+		attr:   nflog.Attribute{Mark: &mark, Hook: &hook, UID: &uid, GID: &gid, Prefix: &prefix},
+		family: conntrack.IPv4,
+		con: conntrack.Con{
+			Origin: &conntrack.IPTuple{Src: &src, Dst: &dst, Proto: &conntrack.ProtoTuple{Number: &proto, SrcPort: &sport, DstPort: &dport}},
+			Mark:   &ctMark,
+			Zone:   &zone,
+		},
+		iif:   "eth0",
+		oif:   "eth1",
+		vlans: []uint16{100},
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"tcp", true},
+		{"udp", false},
+		{"proto 6", true},
+		{"ip", true},
+		{"ip6", false},
+		{"family inet6", false},
+		{"tcp and dport 22", true},
+		{"tcp and dport 23", false},
+		{"udp or dport 22", true},
+		{"udp or dport 23", false},
+		{"not udp", true},
+		{"! tcp", false},
+		{"not (udp or icmp) and src net 10.0.0.0/8", true},
+		{"src host 10.0.0.1", true},
+		{"dst host 10.0.0.1", false},
+		{"host 192.0.2.1", true},
+		{"net 198.51.100.0/24", false},
+		{"port 22", true},
+		{"port 40000", true},
+		{"port 80", false},
+		{"port 20-30", true},
+		{"sport 20-30", false},
+		{"dport == 22", true},
+		{"dport != 22", false},
+		{"sport != 22", true},
+		{"port != 22", false},
+		{"port != 80", true},
+		{"dport < 22", false},
+		{"dport <= 22", true},
+		{"sport > 1024", true},
+		{"sport >= 40001", false},
+		{"port > 30000", true},
+		{"mark 0x10", true},
+		{"mark 0x100/0x100", false},
+		{"ctmark 0x100/0x100", true},
+		{"ctmark 0x10", false},
+		{"zone 3", true},
+		{"zone != 3", false},
+		{"zone < 3", false},
+		{"zone >= 3", true},
+		{"uid 1000 and gid 100", true},
+		{"uid > 1000", false},
+		{"hook forward", true},
+		{"hook input", false},
+		{"iif eth0", true},
+		{"oif eth0", false},
+		{`prefix "ct drop"`, true},
+		{"prefix drop", false},
+		{"vlan 100", true},
+		{"vlan 200", false},
+	}
+	p := testPacket()
+	for _, tt := range tests {
+		m, err := compileFilter(tt.expr)
+		if err != nil {
+			t.Errorf("compileFilter(%q) failed: %v", tt.expr, err)
+			continue
+		}
+		if got := m(p); got != tt.want {
+			t.Errorf("filter %q matched %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestFilterMatchMissingAttributes(t *testing.T) {
+	// numeric comparisons and marks never match attributes the packet does not carry, also with !=
+	p := &packet{family: conntrack.IPv4, con: conntrack.Con{Origin: testPacket().con.Origin}}
+	for _, expr := range []string{"zone != 3", "uid != 0", "hook != input", "mark 0/0", "ctmark 0/0", "vlan 100", "iif eth0"} {
+		m, err := compileFilter(expr)
+		if err != nil {
+			t.Fatalf("compileFilter(%q) failed: %v", expr, err)
+		}
+		if m(p) {
+			t.Errorf("filter %q matched a packet without the attribute", expr)
+		}
+	}
+}
+
+func TestUsesCtMark(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"ctmark 0x10", true},
+		{"tcp and not (udp or ctmark 1/1)", true},
+		{"mark 0x10 and tcp", false},
+	}
+	for _, tt := range tests {
+		node, err := parseFilter(tt.expr)
+		if err != nil {
+			t.Fatalf("parseFilter(%q) failed: %v", tt.expr, err)
+		}
+		if got := usesCtMark(node); got != tt.want {
+			t.Errorf("usesCtMark(%q) = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"time"
+
+	conntrack "github.com/florianl/go-conntrack"
+)
+
+const (
+	defaultFragmentWindow = 2 * time.Second
+	defaultFragmentSize   = 1024
+)
+
+type fragmentConfig struct {
+	Window           time.Duration `yaml:"window"`
+	Size             int           `yaml:"size"`
+	HostPairFallback bool          `yaml:"host_pair_fallback"`
+}
+
+// fragmentCache remembers the tuples of first fragments for the later fragments of the same datagram,
+// which carry no upper layer header
+type fragmentCache = lruCache[*conntrack.IPTuple]
+
+func newFragmentCache(window time.Duration, size int) *fragmentCache {
+	return newLRUCache[*conntrack.IPTuple](cmp.Or(window, defaultFragmentWindow), cmp.Or(size, defaultFragmentSize))
+}
+
+// fragmentKey identifies the datagram of a fragment by its addresses, protocol and identification
+func fragmentKey(family conntrack.Family, t *conntrack.IPTuple, frag *fragment) string {
+	return fmt.Sprintf("%d %s %s %d %d", family, t.Src, t.Dst, frag.proto, frag.id)
+}
+
+// hostPairScope selects the entries of the address pair and protocol of a fragment in either direction, in the zones
+// of the listener
+var hostPairScope = &scope{name: scopePairProto, bothDirections: true, maxEntries: defaultScopeMaxEntries}
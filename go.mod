@@ -11,6 +11,7 @@ require (
 	github.com/x-way/iptables-tracer v0.0.0-20260709060440-2854f576e3e9
 	github.com/x-way/pktdump v0.0.7
 	golang.org/x/sys v0.47.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
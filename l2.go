@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/binary"
+
+	conntrack "github.com/florianl/go-conntrack"
+	nflog "github.com/florianl/go-nflog/v2"
+	"golang.org/x/sys/unix"
+)
+
+// ethertypes of the layer 2 encapsulations in front of the IP header
+const (
+	ethPQinQ       = 0x9100
+	pppProtoIP     = 0x0021
+	pppProtoIPv6   = 0x0057
+	ethHeaderLen   = 14
+	vlanHeaderLen  = 4
+	pppoeHeaderLen = 8 // PPPoE session header and PPP protocol
+)
+
+// networkPayload returns the family and the IP packet of an NFLOG message and the IDs of its VLAN tags. Bridge family
+// logging reports the ethertype of the outermost encapsulation and may put the VLAN, QinQ and PPPoE headers into the
+// layer 2 header or the payload, both are walked to the IP header. Without hardware protocol and layer 2 header the
+// family is taken from the IP version, without payload (copy_mode meta) it is 0 unless the hardware protocol is IP.
+func networkPayload(m nflog.Attribute) (conntrack.Family, []byte, []uint16) {
+	var vlans []uint16
+	if m.VLAN != nil {
+		vlans = append(vlans, m.VLAN.TCI&0x0fff)
+	}
+	var payload []byte
+	if m.Payload != nil {
+		payload = *m.Payload
+	}
+	var ethertype uint16
+	var data []byte
+	switch {
+	case m.Layer2Hdr != nil && len(*m.Layer2Hdr) >= ethHeaderLen:
+		l2 := *m.Layer2Hdr
+		ethertype = binary.BigEndian.Uint16(l2[12:14])
+		data = append(l2[ethHeaderLen:len(l2):len(l2)], payload...)
+	case m.HwProtocol != nil:
+		ethertype, data = *m.HwProtocol, payload
+	default:
+		if len(payload) > 0 {
+			switch payload[0] >> 4 {
+			case 4:
+				return conntrack.IPv4, payload, vlans
+			case 6:
+				return conntrack.IPv6, payload, vlans
+			}
+		}
+		return 0, payload, vlans
+	}
+	family, data, tags := walkL2(ethertype, data)
+	if family == 0 {
+		return 0, payload, vlans
+	}
+	return family, data, append(vlans, tags...)
+}
+
+// walkL2 walks the VLAN, QinQ and PPPoE session headers following an ethertype to the IP header and returns the
+// family and the IP packet and the IDs of the VLAN tags, the family is 0 for other protocols
+func walkL2(ethertype uint16, data []byte) (conntrack.Family, []byte, []uint16) {
+	var vlans []uint16
+	for {
+		switch ethertype {
+		case unix.ETH_P_IP:
+			return conntrack.IPv4, data, vlans
+		case unix.ETH_P_IPV6:
+			return conntrack.IPv6, data, vlans
+		case unix.ETH_P_8021Q, unix.ETH_P_8021AD, ethPQinQ:
+			if len(data) < vlanHeaderLen {
+				return 0, nil, nil
+			}
+			vlans = append(vlans, binary.BigEndian.Uint16(data[0:2])&0x0fff)
+			ethertype, data = binary.BigEndian.Uint16(data[2:4]), data[vlanHeaderLen:]
+		case unix.ETH_P_PPP_SES:
+			if len(data) < pppoeHeaderLen {
+				return 0, nil, nil
+			}
+			switch binary.BigEndian.Uint16(data[6:8]) {
+			case pppProtoIP:
+				ethertype = unix.ETH_P_IP
+			case pppProtoIPv6:
+				ethertype = unix.ETH_P_IPV6
+			default:
+				return 0, nil, nil
+			}
+			data = data[pppoeHeaderLen:]
+		default:
+			return 0, nil, nil
+		}
+	}
+}
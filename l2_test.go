@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"slices"
+	"testing"
+
+	conntrack "github.com/florianl/go-conntrack"
+	nflog "github.com/florianl/go-nflog/v2"
+	"golang.org/x/sys/unix"
+)
+
+func TestNetworkPayloadWithoutPayload(t *testing.T) {
+	ipv6, vlan := uint16(unix.ETH_P_IPV6), uint16(unix.ETH_P_8021Q)
+	tests := []struct {
+		name string
+		m    nflog.Attribute
+		want conntrack.Family
+	}{
+		{"no hardware protocol", nflog.Attribute{}, 0},
+		{"IPv6 hardware protocol", nflog.Attribute{HwProtocol: &ipv6}, conntrack.IPv6},
+		{"VLAN hardware protocol", nflog.Attribute{HwProtocol: &vlan}, 0},
+	}
+	for _, tt := range tests {
+		if family, payload, _ := networkPayload(tt.m); family != tt.want || len(payload) != 0 {
+			t.Errorf("%s: networkPayload() = %d, %x, want %d without payload", tt.name, family, payload, tt.want)
+		}
+	}
+}
+
+func TestTupleFamily(t *testing.T) {
+	v4, v6 := net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")
+	tests := []struct {
+		tuple *conntrack.IPTuple
+		want  conntrack.Family
+	}{
+		{&conntrack.IPTuple{Src: &v4}, conntrack.IPv4},
+		{&conntrack.IPTuple{Src: &v6}, conntrack.IPv6},
+		{&conntrack.IPTuple{}, 0},
+	}
+	for _, tt := range tests {
+		if got := tupleFamily(tt.tuple); got != tt.want {
+			t.Errorf("tupleFamily(%v) = %d, want %d", tt.tuple.Src, got, tt.want)
+		}
+	}
+}
+
+func TestNetworkPayload(t *testing.T) {
+	const (
+		ipv4 = "450000201234000040887bebc0000201c633640204d2138c0008000072747021"
+		ipv6 = "600000000014214020010db800000000000000000000000120010db80000000000000000000000029c40138904000000010000000000000100000000"
+	)
+	tests := []struct {
+		name      string
+		hwProto   uint16
+		layer2Hdr string
+		vlan      *nflog.VLAN
+		payload   string
+		family    conntrack.Family
+		packet    string
+		vlans     []uint16
+	}{
+		{
+			name:    "802.1Q",
+			hwProto: unix.ETH_P_8021Q,
+			payload: "00640800" + ipv4,
+			family:  conntrack.IPv4,
+			packet:  ipv4,
+			vlans:   []uint16{100},
+		},
+		{
+			name:    "802.1ad QinQ",
+			hwProto: unix.ETH_P_8021AD,
+			payload: "00c88100206486dd" + ipv6,
+			family:  conntrack.IPv6,
+			packet:  ipv6,
+			vlans:   []uint16{200, 100},
+		},
+		{
+			name:    "0x9100 QinQ",
+			hwProto: ethPQinQ,
+			payload: "012c0800" + ipv4,
+			family:  conntrack.IPv4,
+			packet:  ipv4,
+			vlans:   []uint16{300},
+		},
+		{
+			name:    "PPPoE IPv4",
+			hwProto: unix.ETH_P_PPP_SES,
+			payload: "1100123400220021" + ipv4,
+			family:  conntrack.IPv4,
+			packet:  ipv4,
+		},
+		{
+			name:    "PPPoE IPv6",
+			hwProto: unix.ETH_P_PPP_SES,
+			payload: "11001234003e0057" + ipv6,
+			family:  conntrack.IPv6,
+			packet:  ipv6,
+		},
+		{
+			name:    "PPPoE in 802.1Q",
+			hwProto: unix.ETH_P_8021Q,
+			payload: "006488641100123400220021" + ipv4,
+			family:  conntrack.IPv4,
+			packet:  ipv4,
+			vlans:   []uint16{100},
+		},
+		{
+			name:      "802.1Q in the layer 2 header",
+			hwProto:   unix.ETH_P_8021Q,
+			layer2Hdr: "020000000002020000000001810000640800",
+			payload:   ipv4,
+			family:    conntrack.IPv4,
+			packet:    ipv4,
+			vlans:     []uint16{100},
+		},
+		{
+			name:      "offloaded VLAN tag and 802.1Q in the payload",
+			hwProto:   unix.ETH_P_8021Q,
+			layer2Hdr: "0200000000020200000000018100",
+			vlan:      &nflog.VLAN{Proto: unix.ETH_P_8021Q, TCI: 0x200a},
+			payload:   "00640800" + ipv4,
+			family:    conntrack.IPv4,
+			packet:    ipv4,
+			vlans:     []uint16{10, 100},
+		},
+		{
+			name:    "IP version without hardware protocol",
+			payload: ipv6,
+			family:  conntrack.IPv6,
+			packet:  ipv6,
+		},
+		{
+			name:    "truncated 802.1Q",
+			hwProto: unix.ETH_P_8021Q,
+			payload: "0064",
+			packet:  "0064",
+		},
+		{
+			name:    "truncated QinQ",
+			hwProto: unix.ETH_P_8021AD,
+			payload: "00c88100",
+			packet:  "00c88100",
+		},
+		{
+			name:    "truncated PPPoE",
+			hwProto: unix.ETH_P_PPP_SES,
+			payload: "110012340022",
+			packet:  "110012340022",
+		},
+		{
+			name:    "PPPoE LCP",
+			hwProto: unix.ETH_P_PPP_SES,
+			payload: "110012340006c02101010004",
+			packet:  "110012340006c02101010004",
+		},
+		{
+			name:    "ARP",
+			hwProto: unix.ETH_P_ARP,
+			payload: "0001080006040001",
+			packet:  "0001080006040001",
+		},
+	}
+	for _, tt := range tests {
+		m := nflog.Attribute{VLAN: tt.vlan}
+		if tt.hwProto != 0 {
+			m.HwProtocol = &tt.hwProto
+		}
+		if tt.layer2Hdr != "" {
+			l2 := mustDecodeHex(t, tt.layer2Hdr)
+			m.Layer2Hdr = &l2
+		}
+		payload := mustDecodeHex(t, tt.payload)
+		m.Payload = &payload
+		family, packet, vlans := networkPayload(m)
+		if family != tt.family || !bytes.Equal(packet, mustDecodeHex(t, tt.packet)) || !slices.Equal(vlans, tt.vlans) {
+			t.Errorf("%s: networkPayload() = %d, %x, %v, want %d, %s, %v", tt.name, family, packet, vlans, tt.family, tt.packet, tt.vlans)
+		}
+	}
+}
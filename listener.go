@@ -0,0 +1,723 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	conntrack "github.com/florianl/go-conntrack"
+	nflog "github.com/florianl/go-nflog/v2"
+	ctprint "github.com/x-way/iptables-tracer/pkg/ctprint"
+	"golang.org/x/sys/unix"
+)
+
+type listener struct {
+	name      string
+	group     uint16
+	netns     string
+	copyMode  byte
+	copyRange uint32
+	qthresh   uint32
+	timeout   uint32
+	flags     uint16
+	debug     bool
+	rules     []*rule
+	action    *action
+	protect   matcher
+	limit     *tokenBucket
+	dedup     *dedupCache
+	retries   *retryQueue
+
+	// whether the protection depends on the conntrack mark, which entries decoded from the payload do not carry
+	protectCtMark bool
+
+	// zone selection for entries decoded from the packet payload
+	zone       *uint16
+	ifaceZones map[string]uint16
+	tryZones   []uint16
+
+	// protocols decoded from the packet payload with the protocol number only
+	genericProtocols map[uint8]bool
+
+	// tuples of first fragments and whether unresolved fragments delete all entries of the host pair
+	fragments        *fragmentCache
+	hostPairFallback bool
+
+	// conntrack entries found for PPTP call IDs
+	greKeys *greKeyCache
+
+	// tunnel decapsulation, the inner packets are handled by a copy of the listener
+	tunnel *tunnelDecap
+
+	// whether entries reported by NFLOG are only deleted if their conntrack ID still matches (default)
+	deleteByID bool
+
+	logger *log.Logger
+	nfct   *conntrack.Nfct
+}
+
+// parseListenerSpec parses a listener specification of the form GROUP[:ACTION][:debug]
+func parseListenerSpec(spec string) (*listenerConfig, error) {
+	parts := strings.Split(spec, ":")
+	group, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NFLOG group %q", parts[0])
+	}
+	g := uint16(group)
+	lc := &listenerConfig{
+		Group: &g,
+	}
+	for _, part := range parts[1:] {
+		switch part {
+		case actionDelete, actionLog:
+			lc.Action = part
+		case "debug":
+			lc.Debug = true
+		default:
+			return nil, fmt.Errorf("invalid option %q for NFLOG group %d", part, group)
+		}
+	}
+	return lc, nil
+}
+
+// listenerList collects the listeners given with repeated -g flags
+type listenerList []*listenerConfig
+
+func (ll *listenerList) String() string {
+	var groups []string
+	for _, lc := range *ll {
+		groups = append(groups, strconv.Itoa(int(*lc.Group)))
+	}
+	return strings.Join(groups, ",")
+}
+
+func (ll *listenerList) Set(value string) error {
+	lc, err := parseListenerSpec(value)
+	if err != nil {
+		return err
+	}
+	for _, other := range *ll {
+		if *other.Group == *lc.Group {
+			return fmt.Errorf("NFLOG group %d specified more than once", *lc.Group)
+		}
+	}
+	*ll = append(*ll, lc)
+	return nil
+}
+
+// selectAction returns the action of the first matching rule or the default action of the listener without a rule
+func (l *listener) selectAction(p *packet) (*action, *rule) {
+	for _, r := range l.rules {
+		if r.action != nil && r.match(p) {
+			return r.action, r
+		}
+	}
+	return l.action, nil
+}
+
+// admit checks whether a deletion is allowed by the circuit breaker and the rate limits,
+// it returns the reason if the deletion is not allowed
+func (l *listener) admit(r *rule) string {
+	if breaker.isOpen() {
+		return "circuit_breaker"
+	}
+	now := time.Now()
+	if r != nil && r.limit != nil && !r.limit.allow(now) {
+		breaker.limited(now)
+		return "rule"
+	}
+	if l.limit != nil && !l.limit.allow(now) {
+		breaker.limited(now)
+		return "global"
+	}
+	return ""
+}
+
+// payloadZones returns the conntrack zones to try for an entry decoded from the packet payload,
+// the zone of the input or output interface takes precedence over the zone of the listener
+func (l *listener) payloadZones(iif, oif string) []uint16 {
+	for _, iface := range []string{iif, oif} {
+		if zone, ok := l.ifaceZones[iface]; ok && iface != "" {
+			return []uint16{zone}
+		}
+	}
+	if l.zone != nil {
+		return []uint16{*l.zone}
+	}
+	return l.tryZones
+}
+
+func withZone(con conntrack.Con, zone uint16) conntrack.Con {
+	con.Zone = &zone
+	return con
+}
+
+// familyName returns the family label of the metrics
+func familyName(family conntrack.Family) string {
+	switch family {
+	case conntrack.IPv4:
+		return "inet"
+	case conntrack.IPv6:
+		return "inet6"
+	}
+	return "unknown"
+}
+
+// tupleFamily returns the family of a CT tuple by the length of its addresses
+func tupleFamily(t *conntrack.IPTuple) conntrack.Family {
+	switch {
+	case t.Src == nil:
+		return 0
+	case t.Src.To4() != nil:
+		return conntrack.IPv4
+	}
+	return conntrack.IPv6
+}
+
+// bindKey identifies the NFLOG group bound by the listener
+func (l *listener) bindKey() string {
+	return fmt.Sprintf("%s:%d", l.netns, l.group)
+}
+
+// socketKey identifies all NFLOG socket parameters of the listener
+func (l *listener) socketKey() string {
+	return fmt.Sprintf("%s:%d:%d:%d:%d:%d", l.bindKey(), l.copyMode, l.copyRange, l.qthresh, l.timeout, l.flags)
+}
+
+// handle handles an NFLOG message, for tunnel packets the conntrack entries of the outer and the inner flow are
+// deleted as configured
+func (l *listener) handle(m nflog.Attribute) int {
+	if l.tunnel != nil && m.Payload != nil {
+		if _, payload, _ := networkPayload(m); payload != nil {
+			if tp, ok := l.tunnel.decapsulate(payload); ok {
+				tunnelCounter.WithLabelValues(l.name, tp.protocol).Inc()
+				if l.tunnel.inner {
+					l.innerListener(tp).handlePacket(tp.attribute(m))
+				}
+				if !l.tunnel.outer {
+					return 0
+				}
+			}
+		}
+	}
+	return l.handlePacket(m)
+}
+
+// innerListener returns the listener handling the inner packet of a tunnel packet, the zone of the tunnel key or
+// VNI takes precedence over the zones of the listener
+func (l *listener) innerListener(tp *tunnelPacket) *listener {
+	inner := *l
+	inner.name = l.name + "/inner"
+	inner.tunnel = nil
+	inner.ifaceZones = nil
+	inner.logger = l.tunnel.logger
+	inner.nfct = l.tunnel.nfct
+	if tp.id != nil {
+		if zone, ok := l.tunnel.zones[*tp.id]; ok {
+			inner.zone, inner.tryZones = &zone, nil
+		}
+	}
+	return &inner
+}
+
+func (l *listener) handlePacket(m nflog.Attribute) int {
+	var con conntrack.Con
+	var candidates []conntrack.Con
+	var info payloadInfo
+	var hostPair bool
+	var sc *scope
+	var err error
+	var ctBytes []byte
+	var fwMark uint32
+	var iif string
+	var oif string
+	protoStr := "0"
+	ctinfoStr := "0x0"
+	ctInfo := ^uint32(0)
+	if m.CtInfo != nil {
+		ctInfo = *m.CtInfo
+		ctinfoStr = fmt.Sprintf("0x%x", ctInfo)
+	}
+	ctFamily, payloadBytes, vlans := networkPayload(m)
+	familyStr := familyName(ctFamily)
+	if m.Ct != nil {
+		ctBytes = *m.Ct
+		if con, err = conntrack.ParseAttributes(l.logger, ctBytes); err != nil {
+			l.logger.Printf("Could not extract Con from CT info: %v", err)
+			errorCounter.WithLabelValues(l.name, familyStr, protoStr, ctinfoStr, "ctinfo_extract").Inc()
+			return 0
+		}
+		if ctFamily == 0 && con.Origin != nil {
+			// without payload (copy_mode meta) the family is taken from the addresses of the CT tuple
+			ctFamily = tupleFamily(con.Origin)
+			familyStr = familyName(ctFamily)
+		}
+	} else {
+		if l.debug {
+			l.logger.Print("No NFLOG CT info found, decoding information from payload")
+		}
+	}
+	if m.Payload != nil {
+		if con.Origin == nil {
+			if con, info, err = extractConFromPayload(payloadBytes, l.genericProtocols); err != nil {
+				l.logger.Printf("Could not extract CT attrs from packet payload: %v", err)
+				errorCounter.WithLabelValues(l.name, familyStr, protoStr, ctinfoStr, "payload_extract").Inc()
+				return 0
+			}
+			if frag := info.fragment; frag != nil {
+				if hostPair, err = l.resolveFragment(ctFamily, &con, frag); err != nil {
+					l.logger.Printf("Could not resolve IP fragment: %v", err)
+					errorCounter.WithLabelValues(l.name, familyStr, strconv.Itoa(int(*con.Origin.Proto.Number)), ctinfoStr, "fragment").Inc()
+					return 0
+				}
+			}
+			switch {
+			case hostPair:
+				// the entries of the host pair are looked up once the deletion is admitted
+				sc = hostPairScope
+			case needsKeyLookup(con):
+				if con, err = lookupGREKeys(l.nfct, l.greKeys, l.name, ctFamily, con); err != nil {
+					l.logger.Printf("Could not look up GRE keys: %v", err)
+					errorCounter.WithLabelValues(l.name, familyStr, "47", ctinfoStr, "gre_lookup").Inc()
+					return 0
+				}
+				candidates = []conntrack.Con{{Origin: con.Origin, Zone: con.Zone}}
+			default:
+				direction := ctInfo
+				if info.embedded {
+					direction = embeddedCtInfo(ctInfo)
+				}
+				con, candidates = payloadCandidates(con, direction, m.Hook)
+			}
+		}
+	} else if con.Origin == nil {
+		l.logger.Print("No NFLOG payload found, ignoring packet")
+		errorCounter.WithLabelValues(l.name, familyStr, protoStr, ctinfoStr, "no_payload").Inc()
+		return 0
+	}
+	if m.Mark != nil {
+		fwMark = *m.Mark
+	}
+	if m.InDev != nil {
+		iif = GetIfaceName(*m.InDev)
+	}
+	if m.OutDev != nil {
+		oif = GetIfaceName(*m.OutDev)
+	}
+	if con.Origin == nil {
+		l.logger.Print("List of extracted CT attributes is empty, ignoring packet")
+		errorCounter.WithLabelValues(l.name, familyStr, protoStr, ctinfoStr, "no_ctattrs").Inc()
+		return 0
+	}
+	if con.Origin.Proto != nil && con.Origin.Proto.Number != nil {
+		protoStr = fmt.Sprintf("%d", *con.Origin.Proto.Number)
+	}
+	if candidates == nil && sc == nil {
+		candidates = []conntrack.Con{l.ctDeletion(con)}
+	} else if zones := l.payloadZones(iif, oif); len(zones) > 0 && con.Zone == nil && sc == nil {
+		con = withZone(con, zones[0])
+		var zoned []conntrack.Con
+		for _, zone := range zones {
+			for _, c := range candidates {
+				zoned = append(zoned, withZone(c, zone))
+			}
+		}
+		candidates = zoned
+	}
+	p := &packet{attr: m, family: ctFamily, con: con, iif: iif, oif: oif, vlans: vlans}
+	a, r := l.selectAction(p)
+	if a.kind == actionIgnore {
+		if l.debug {
+			l.logger.Printf("Ignoring packet (action %s)", a.name)
+		}
+		return 0
+	}
+	ctEntry := formatCon(con)
+	switch {
+	case info.embedded:
+		ctEntry += " (from ICMP error)"
+	case hostPair:
+		ctEntry += " (host pair of IP fragment)"
+	}
+	if len(ctBytes) > 0 {
+		if ctEntry, err = ctprint.Format(ctBytes); err != nil {
+			l.logger.Printf("Could not format ctBytes: %s", err)
+		}
+	}
+	if r != nil {
+		ctEntry = fmt.Sprintf("%s (rule %s)", ctEntry, r.name)
+	}
+	verb, doing := a.verbs()
+	if a.modifies() && l.protect != nil {
+		var protected bool
+		if sc == nil && a.scope == nil {
+			if candidates, err = l.unprotected(p, candidates); err != nil {
+				l.logger.Printf("Could not get CT entry to check the protected marks: %v", err)
+				errorCounter.WithLabelValues(l.name, familyStr, protoStr, ctinfoStr, "protect_lookup").Inc()
+				return 0
+			}
+			protected = len(candidates) == 0
+		} else {
+			protected = l.protect(p)
+		}
+		if protected {
+			l.logger.Printf("Not %s protected CT entry: %s", doing, ctEntry)
+			protectedCounter.WithLabelValues(l.name, familyStr, protoStr, ctinfoStr).Inc()
+			return 0
+		}
+	}
+	dryRun := a.modifies() && (a.dryRun || dryRunEnabled.Load())
+	var dedupKey string
+	if a.modifies() && !dryRun && l.dedup != nil && (r == nil || r.dedup) {
+		dedupKey = conKey(ctFamily, con)
+		if a.update != nil || a.scope != nil {
+			dedupKey += " " + a.name
+		}
+		if _, ok := l.dedup.get(dedupKey, time.Now()); ok {
+			dedupCounter.WithLabelValues(l.name, "hit").Inc()
+			if l.debug {
+				l.logger.Printf("Skipping recently %sd CT entry: %s", verb, ctEntry)
+			}
+			return 0
+		}
+		dedupCounter.WithLabelValues(l.name, "miss").Inc()
+	}
+	if a.modifies() && a.scope != nil && sc == nil {
+		sc = a.scope
+		ctEntry += fmt.Sprintf(" (scope %s)", sc.name)
+	}
+	labels := []string{l.name, familyStr, protoStr, ctinfoStr}
+	if a.modifies() && sc == nil && !l.meetsConditions(a, r, ctFamily, candidates, ctEntry, labels) {
+		return 0
+	}
+	var limited string
+	if a.modifies() && !dryRun {
+		limited = l.admit(r)
+	}
+	if a.modifies() && sc != nil && limited == "" {
+		// the table is only dumped for admitted deletions
+		if candidates, err = sc.entries(l.nfct, ctFamily, con, l.scopeZones(con, len(ctBytes) == 0, iif, oif)); err != nil {
+			l.logger.Printf("Could not look up CT entries in scope %s: %v", sc.name, err)
+			reason := "scope_lookup"
+			if hostPair {
+				reason = "host_pair_lookup"
+			}
+			errorCounter.WithLabelValues(l.name, familyStr, protoStr, ctinfoStr, reason).Inc()
+			return 0
+		}
+		if hostPair && len(candidates) == 0 {
+			if l.debug {
+				l.logger.Printf("No CT entries for host pair of IP fragment: %s", formatCon(con))
+			}
+			notFoundCounter.WithLabelValues(l.name, familyStr, protoStr, ctinfoStr, "0").Inc()
+			return 0
+		}
+		ctEntry += fmt.Sprintf(" (%d entries)", len(candidates))
+		if len(candidates) > sc.maxEntries {
+			l.logger.Printf("Not %s CT entries (%d entries exceed the maximum of %d): %s", doing, len(candidates), sc.maxEntries, ctEntry)
+			scopeLimitCounter.WithLabelValues(l.name).Inc()
+			return 0
+		}
+	}
+	switch {
+	case a.kind == actionLog:
+		l.logger.Printf("Matched CT entry: %s", ctEntry)
+	case dryRun:
+		l.logger.Printf("Would %s CT entry (dry-run): %s", verb, ctEntry)
+	case limited != "":
+		l.logger.Printf("Not %s CT entry (%s): %s", doing, limitReason(limited), ctEntry)
+	case a.update != nil:
+		l.logger.Printf("Updating CT entry (%s): %s", a.update, ctEntry)
+	default:
+		l.logger.Printf("Deleting CT entry: %s", ctEntry)
+	}
+	if l.debug {
+		l.logger.Printf("  Packet: %s", formatPkt(ctFamily, time.Now(), fwMark, iif, oif, payloadBytes, ctBytes, ctInfo))
+		if len(ctBytes) == 0 {
+			var tuples []string
+			for _, c := range candidates {
+				tuples = append(tuples, formatCon(c))
+			}
+			l.logger.Printf("  Candidates: %s", strings.Join(tuples, " | "))
+		}
+	}
+	if a.kind == actionLog {
+		logCounter.WithLabelValues(l.name, familyStr, protoStr, ctinfoStr).Inc()
+		return 0
+	}
+	if dryRun {
+		dryRunCounter.WithLabelValues(l.name, familyStr, protoStr, ctinfoStr).Inc()
+		return 0
+	}
+	if limited != "" {
+		rateLimitedCounter.WithLabelValues(l.name, limited).Inc()
+		return 0
+	}
+	if dedupKey != "" {
+		l.dedup.add(dedupKey, struct{}{}, time.Now())
+	}
+	if sc != nil {
+		// the token taken above is charged for the first deleted entry, every further entry takes its own token
+		charged := true
+		for i, c := range candidates {
+			entry := formatCon(c)
+			if l.protect != nil && l.protect(&packet{attr: m, family: ctFamily, con: c, iif: iif, oif: oif, vlans: vlans}) {
+				l.logger.Printf("Not %s protected CT entry: %s", doing, entry)
+				protectedCounter.WithLabelValues(labels...).Inc()
+				continue
+			}
+			if !l.meetsConditions(a, r, ctFamily, []conntrack.Con{scopedDeletion(c)}, entry, labels) {
+				continue
+			}
+			if !charged {
+				if limited := l.admit(r); limited != "" {
+					l.logger.Printf("Not %s %d remaining CT entries (%s): %s", doing, len(candidates)-i, limitReason(limited), ctEntry)
+					rateLimitedCounter.WithLabelValues(l.name, limited).Add(float64(len(candidates) - i))
+					break
+				}
+			}
+			charged = false
+			l.delete(&deletion{l: l, family: ctFamily, cons: []conntrack.Con{scopedDeletion(c)}, update: a.update, cascade: a.cascade, entry: entry, labels: labels})
+		}
+		return 0
+	}
+	l.delete(&deletion{l: l, family: ctFamily, cons: candidates, embedded: info.embedded, update: a.update, cascade: a.cascade, entry: ctEntry, labels: labels})
+	return 0
+}
+
+// scopeZones returns the zones in which the entries of a wildcard scope are selected, the zone reported by the kernel
+// or the zones configured for entries decoded from the packet payload
+func (l *listener) scopeZones(con conntrack.Con, fromPayload bool, iif, oif string) []uint16 {
+	if fromPayload {
+		if zones := l.payloadZones(iif, oif); len(zones) > 0 {
+			return zones
+		}
+	}
+	if con.Zone != nil {
+		return []uint16{*con.Zone}
+	}
+	return []uint16{0}
+}
+
+// limitReason describes why admit did not allow a deletion
+func limitReason(limited string) string {
+	if limited == "circuit_breaker" {
+		return "circuit breaker open"
+	}
+	return limited + " rate limit exceeded"
+}
+
+// resolveFragment completes the tuple of a non-first fragment from the first fragment of the datagram and remembers
+// the tuple of a first fragment, it reports whether the entries of the host pair have to be deleted instead
+func (l *listener) resolveFragment(family conntrack.Family, con *conntrack.Con, frag *fragment) (bool, error) {
+	key := fragmentKey(family, con.Origin, frag)
+	if frag.first {
+		fragmentCounter.WithLabelValues(l.name, "first").Inc()
+		l.fragments.add(key, con.Origin, time.Now())
+		return false, nil
+	}
+	if tuple, ok := l.fragments.get(key, time.Now()); ok {
+		fragmentCounter.WithLabelValues(l.name, "cached").Inc()
+		con.Origin = tuple
+		return false, nil
+	}
+	if l.hostPairFallback {
+		fragmentCounter.WithLabelValues(l.name, "host_pair").Inc()
+		return true, nil
+	}
+	fragmentCounter.WithLabelValues(l.name, "unresolved").Inc()
+	return false, fmt.Errorf("no first fragment of datagram %d seen within the window", frag.id)
+}
+
+// delete deletes or updates a conntrack entry, trying the candidate tuples in order while they are not found, and accounts for the outcome, transient failures are queued for a retry
+func (l *listener) delete(del *deletion) {
+	var err error
+	if del.cascade != nil && del.attempt == 0 {
+		// the cascade runs once, retries only repeat the deletion of the entry itself
+		if del.cascaded, err = l.cascadeDelete(del); err != nil {
+			l.logger.Printf("Could not delete expectations and related CT entries: %v", err)
+			errorCounter.WithLabelValues(append(del.labels, "cascade")...).Inc()
+		}
+		cascadeCounter.WithLabelValues(l.name, "expectation").Add(float64(del.cascaded.expected))
+		cascadeCounter.WithLabelValues(l.name, "related").Add(float64(del.cascaded.related))
+	}
+	zone := "0"
+	for _, con := range del.cons {
+		if con.Zone != nil {
+			zone = strconv.Itoa(int(*con.Zone))
+		}
+		if err = l.modify(del, con); !errors.Is(err, unix.ENOENT) {
+			break
+		}
+	}
+	switch {
+	case err == nil && del.update != nil:
+		updateCounter.WithLabelValues(append(del.labels, zone)...).Inc()
+		return
+	case err == nil:
+		if del.cascade != nil {
+			l.logger.Printf("Deleted CT entry with %d expectations and %d related entries (%d protected related entries kept): %s", del.cascaded.expected, del.cascaded.related, del.cascaded.protected, del.entry)
+		}
+		deleteCounter.WithLabelValues(append(del.labels, zone)...).Inc()
+		if del.embedded {
+			icmpErrorCounter.WithLabelValues(del.labels...).Inc()
+		}
+		return
+	}
+	class, transient := classifyDeleteError(err)
+	if class == "not_found" && l.reusedTuple(del) {
+		idMismatchCounter.WithLabelValues(del.labels...).Inc()
+		return
+	}
+	if class == "not_found" {
+		if l.debug {
+			l.logger.Printf("CT entry already gone: %s", del.entry)
+		}
+		notFoundCounter.WithLabelValues(append(del.labels, zone)...).Inc()
+		return
+	}
+	if transient && l.retries.schedule(del) {
+		l.logger.Printf("conntrack %s failed, retrying (attempt %d): %v", del.operation(), del.attempt, err)
+		retryCounter.WithLabelValues(l.name, class).Inc()
+		return
+	}
+	l.logger.Printf("conntrack %s failed: %v", del.operation(), err)
+	errorCounter.WithLabelValues(append(del.labels, strings.ToLower(del.operation())+"_"+class)...).Inc()
+	l.retries.dead(del, class, err)
+}
+
+// modify deletes or updates a conntrack entry
+func (l *listener) modify(del *deletion, con conntrack.Con) error {
+	if del.update != nil {
+		return del.update.apply(l.nfct, l.logger, del.family, con)
+	}
+	return deleteConntrack(l.nfct, del.family, con)
+}
+
+// meetsConditions checks the conditions of a rule on the live conntrack entry, entries not meeting them are logged
+// and counted with the condition
+func (l *listener) meetsConditions(a *action, r *rule, family conntrack.Family, candidates []conntrack.Con, entry string, labels []string) bool {
+	if r == nil || len(r.conditions) == 0 {
+		return true
+	}
+	name, reason, err := l.checkConditions(r, family, candidates)
+	if err != nil {
+		l.logger.Printf("Could not get CT entry to check the conditions: %v", err)
+		errorCounter.WithLabelValues(append(labels, "condition_lookup")...).Inc()
+		return false
+	}
+	if name != "" {
+		_, doing := a.verbs()
+		l.logger.Printf("Not %s CT entry (%s): %s", doing, reason, entry)
+		skippedCounter.WithLabelValues(l.name, r.name, name).Inc()
+		return false
+	}
+	return true
+}
+
+// unprotected returns the candidates which are not protected, the protection is checked in the zone of every
+// candidate as the candidates of a packet decoded from the payload may be in several zones. Packets decoded from the
+// payload only carry the on-wire tuple, with NAT the protected address or port may only be in the other tuple, so the
+// protection is checked on the live entry. The same goes for protected marks if the mark is unknown, a failed lookup
+// refuses the deletion.
+func (l *listener) unprotected(p *packet, candidates []conntrack.Con) ([]conntrack.Con, error) {
+	var allowed []conntrack.Con
+	lookup := p.con.Reply == nil || (l.protectCtMark && p.con.Mark == nil)
+	for _, c := range candidates {
+		pc := *p
+		if c.Zone != nil {
+			pc.con.Zone = c.Zone
+		}
+		if lookup {
+			entry, err := getConntrack(l.nfct, l.logger, p.family, c)
+			if errors.Is(err, unix.ENOENT) {
+				// nothing to protect, the deletion will not find the entry either
+				allowed = append(allowed, c)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if l.protectCtMark && entry.Mark == nil {
+				return nil, fmt.Errorf("conntrack entry without mark")
+			}
+			if entry.Zone == nil {
+				// the zone attribute is only present for non-zero zones
+				entry.Zone = pc.con.Zone
+			}
+			pc.con = entry
+		}
+		if l.protect(&pc) {
+			if l.debug {
+				l.logger.Printf("Skipping protected candidate: %s", formatCon(c))
+			}
+			continue
+		}
+		allowed = append(allowed, c)
+	}
+	return allowed, nil
+}
+
+// ctDeletion returns the attributes identifying a conntrack entry reported by NFLOG, the ID unless delete_by_id is
+// disabled
+func (l *listener) ctDeletion(con conntrack.Con) conntrack.Con {
+	del := conntrack.Con{Origin: con.Origin, Reply: con.Reply, Zone: con.Zone}
+	if l.deleteByID {
+		del.ID = con.ID
+	}
+	return del
+}
+
+// reusedTuple reports whether an entry deleted or updated by ID was not found because its tuple is used by a newer connection
+func (l *listener) reusedTuple(del *deletion) bool {
+	if len(del.cons) != 1 || del.cons[0].ID == nil {
+		return false
+	}
+	lookup := del.cons[0]
+	lookup.ID = nil
+	current, err := getConntrack(l.nfct, l.logger, del.family, lookup)
+	if err != nil || current.ID == nil || *current.ID == *del.cons[0].ID {
+		return false
+	}
+	doing := "deleting"
+	if del.update != nil {
+		doing = "updating"
+	}
+	l.logger.Printf("Not %s CT entry, the tuple is used by a newer connection (ID %d instead of %d): %s", doing, *current.ID, *del.cons[0].ID, del.entry)
+	return true
+}
+
+// formatCon formats the tuples of a connection extracted from the packet payload
+func formatCon(con conntrack.Con) string {
+	var attrs []string
+	for _, t := range []struct {
+		name  string
+		tuple *conntrack.IPTuple
+	}{{"orig", con.Origin}, {"reply", con.Reply}} {
+		if t.tuple == nil {
+			continue
+		}
+		var src, dst, proto string
+		if t.tuple.Src != nil {
+			src = t.tuple.Src.String()
+		}
+		if t.tuple.Dst != nil {
+			dst = t.tuple.Dst.String()
+		}
+		if p := t.tuple.Proto; p != nil {
+			if p.Number != nil {
+				proto = protocolName(*p.Number)
+			}
+			if p.SrcPort != nil && p.DstPort != nil {
+				src = net.JoinHostPort(src, strconv.Itoa(int(*p.SrcPort)))
+				dst = net.JoinHostPort(dst, strconv.Itoa(int(*p.DstPort)))
+			}
+		}
+		attrs = append(attrs, fmt.Sprintf("%s=%s:%s->%s", t.name, proto, src, dst))
+	}
+	return strings.Join(attrs, ", ")
+}
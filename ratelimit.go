@@ -0,0 +1,119 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+type rateLimitConfig struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+type circuitBreakerConfig struct {
+	Sustain    time.Duration `yaml:"sustain"`
+	ResetAfter time.Duration `yaml:"reset_after"`
+}
+
+// tokenBucket limits the number of deletions to rate per second with bursts of up to burst deletions
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = max(1, int(rate))
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// allow takes a token from the bucket if one is available
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.last.IsZero() {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// limitedGap is the longest pause between rate limited deletions which still counts as sustained rate limiting
+const limitedGap = time.Second
+
+// circuitBreaker switches ctrmd into log-only mode when deletions are rate limited for a sustained period
+type circuitBreaker struct {
+	mu           sync.Mutex
+	logger       *log.Logger
+	sustain      time.Duration
+	resetAfter   time.Duration
+	open         bool
+	limitedSince time.Time
+	lastLimited  time.Time
+	timer        *time.Timer
+}
+
+// breaker is the process wide circuit breaker, its state is kept across configuration reloads
+var breaker = &circuitBreaker{}
+
+// configure sets the parameters of the circuit breaker, a zero sustain period disables it
+func (cb *circuitBreaker) configure(logger *log.Logger, cfg circuitBreakerConfig) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.logger = logger
+	cb.sustain = cfg.Sustain
+	cb.resetAfter = cfg.ResetAfter
+}
+
+func (cb *circuitBreaker) isOpen() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.open
+}
+
+// limited records a rate limited deletion and opens the circuit breaker if the rate limiting is sustained
+func (cb *circuitBreaker) limited(now time.Time) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.limitedSince.IsZero() || now.Sub(cb.lastLimited) > limitedGap {
+		cb.limitedSince = now
+	}
+	cb.lastLimited = now
+	if cb.open || cb.sustain <= 0 || now.Sub(cb.limitedSince) < cb.sustain {
+		return
+	}
+	cb.open = true
+	circuitBreakerGauge.Set(1)
+	if cb.resetAfter > 0 {
+		cb.logger.Printf("Deletions rate limited for %s, circuit breaker open for %s: switching to log-only mode", cb.sustain, cb.resetAfter)
+		cb.timer = time.AfterFunc(cb.resetAfter, cb.reset)
+	} else {
+		cb.logger.Printf("Deletions rate limited for %s, circuit breaker open until reset: switching to log-only mode", cb.sustain)
+	}
+}
+
+// reset closes the circuit breaker
+func (cb *circuitBreaker) reset() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.timer != nil {
+		cb.timer.Stop()
+		cb.timer = nil
+	}
+	cb.limitedSince = time.Time{}
+	if !cb.open {
+		return
+	}
+	cb.open = false
+	circuitBreakerGauge.Set(0)
+	cb.logger.Print("Circuit breaker reset, resuming deletions")
+}
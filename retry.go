@@ -0,0 +1,259 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	conntrack "github.com/florianl/go-conntrack"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultRetryAttempts   = 3
+	defaultRetryBackoff    = 100 * time.Millisecond
+	defaultRetryMaxBackoff = 5 * time.Second
+	defaultRetryQueueSize  = 1024
+)
+
+type retryConfig struct {
+	Attempts   *int          `yaml:"attempts"`
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	QueueSize  int           `yaml:"queue_size"`
+}
+
+// classifyDeleteError returns the class of a failed deletion and whether the failure is transient
+func classifyDeleteError(err error) (string, bool) {
+	switch {
+	case errors.Is(err, unix.ENOENT):
+		return "not_found", false
+	case errors.Is(err, unix.EPERM), errors.Is(err, unix.EACCES):
+		return "permission", false
+	case errors.Is(err, unix.EINVAL):
+		return "invalid", false
+	case errors.Is(err, unix.ENOBUFS):
+		return "no_buffer", true
+	case errors.Is(err, unix.EBUSY):
+		return "busy", true
+	case errors.Is(err, unix.EAGAIN), errors.Is(err, unix.EINTR):
+		return "again", true
+	}
+	return "other", false
+}
+
+// deletion is a conntrack entry to be deleted by a listener, or updated if update is set
+type deletion struct {
+	l        *listener
+	family   conntrack.Family
+	cons     []conntrack.Con
+	embedded bool
+	update   *ctUpdate
+	cascade  *cascade
+	cascaded cascadeCounts
+	entry    string
+	labels   []string
+	attempt  int
+	due      time.Time
+}
+
+// operation returns the name of the conntrack operation of the deletion
+func (del *deletion) operation() string {
+	if del.update != nil {
+		return "Update"
+	}
+	return "Delete"
+}
+
+// retryQueue retries deletions which failed with a transient error, with exponential backoff
+type retryQueue struct {
+	mu         sync.Mutex
+	items      []*deletion
+	wake       chan struct{}
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	size       int
+
+	deadLetterPath string
+	deadLetter     *log.Logger
+	deadLetterFile *os.File
+}
+
+func newRetryQueue() *retryQueue {
+	return &retryQueue{wake: make(chan struct{}, 1)}
+}
+
+// configure sets the retry parameters and opens the dead-letter log, an empty path logs to the daemon logger
+func (q *retryQueue) configure(logger *log.Logger, cfg retryConfig, deadLetterPath string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.attempts = defaultRetryAttempts
+	if cfg.Attempts != nil {
+		q.attempts = *cfg.Attempts
+	}
+	q.backoff = cmp.Or(cfg.Backoff, defaultRetryBackoff)
+	q.maxBackoff = cmp.Or(cfg.MaxBackoff, defaultRetryMaxBackoff)
+	q.size = cmp.Or(cfg.QueueSize, defaultRetryQueueSize)
+	if q.deadLetter != nil && deadLetterPath == q.deadLetterPath {
+		return nil
+	}
+	if deadLetterPath == "" {
+		q.closeDeadLetter()
+		q.deadLetterPath = ""
+		q.deadLetter = logger
+		return nil
+	}
+	f, err := os.OpenFile(deadLetterPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		if q.deadLetter == nil {
+			q.deadLetter = logger
+		}
+		return fmt.Errorf("could not open dead-letter log: %v", err)
+	}
+	q.closeDeadLetter()
+	q.deadLetterPath = deadLetterPath
+	q.deadLetterFile = f
+	q.deadLetter = log.New(f, "", log.LstdFlags)
+	return nil
+}
+
+func (q *retryQueue) closeDeadLetter() {
+	if q.deadLetterFile != nil {
+		q.deadLetterFile.Close()
+		q.deadLetterFile = nil
+	}
+}
+
+// schedule queues a deletion for another attempt, it returns false if the attempts are exhausted or the queue is full
+func (q *retryQueue) schedule(del *deletion) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if del.attempt >= q.attempts || len(q.items) >= q.size {
+		return false
+	}
+	backoff := q.backoff << del.attempt
+	if backoff <= 0 || backoff > q.maxBackoff {
+		backoff = q.maxBackoff
+	}
+	del.attempt++
+	del.due = time.Now().Add(backoff)
+	q.items = append(q.items, del)
+	retryQueueGauge.Set(float64(len(q.items)))
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// due removes and returns the deletions whose backoff expired and the time the next deletion is due
+func (q *retryQueue) due(now time.Time) ([]*deletion, time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var due []*deletion
+	var next time.Time
+	pending := q.items[:0]
+	for _, del := range q.items {
+		if !del.due.After(now) {
+			due = append(due, del)
+			continue
+		}
+		if next.IsZero() || del.due.Before(next) {
+			next = del.due
+		}
+		pending = append(pending, del)
+	}
+	q.items = pending
+	retryQueueGauge.Set(float64(len(q.items)))
+	return due, next
+}
+
+// run retries the queued deletions until the context is done
+func (q *retryQueue) run(ctx context.Context, track *inflight) {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-timer.C:
+		}
+		if !track.begin() {
+			return
+		}
+		due, next := q.due(time.Now())
+		for _, del := range due {
+			del.l.delete(del)
+		}
+		track.done()
+		wait := time.Hour
+		if !next.IsZero() {
+			wait = max(0, time.Until(next))
+		}
+		timer.Reset(wait)
+	}
+}
+
+// flush makes a last attempt for all queued deletions until the deadline, deletions failing again and the deletions
+// not attempted before the deadline go to the dead-letter log, it returns false if the deadline expired
+func (q *retryQueue) flush(deadline time.Time) bool {
+	q.mu.Lock()
+	items := q.items
+	q.items = nil
+	q.attempts = 0
+	q.mu.Unlock()
+	retryQueueGauge.Set(0)
+	for i, del := range items {
+		if time.Now().After(deadline) {
+			for _, del := range items[i:] {
+				q.dead(del, "drain_timeout", errors.New("drain timeout expired"))
+			}
+			return false
+		}
+		del.l.delete(del)
+	}
+	return true
+}
+
+// drop removes the queued deletions of a conntrack socket which is closed, they go to the dead-letter log
+func (q *retryQueue) drop(nfct *conntrack.Nfct, err error) {
+	q.mu.Lock()
+	var dropped []*deletion
+	pending := q.items[:0]
+	for _, del := range q.items {
+		if del.l.nfct == nfct {
+			dropped = append(dropped, del)
+			continue
+		}
+		pending = append(pending, del)
+	}
+	q.items = pending
+	retryQueueGauge.Set(float64(len(q.items)))
+	q.mu.Unlock()
+	for _, del := range dropped {
+		q.dead(del, "namespace_closed", err)
+	}
+}
+
+// dead records a deletion which failed permanently
+func (q *retryQueue) dead(del *deletion, reason string, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	deadLetterCounter.WithLabelValues(del.l.name, reason).Inc()
+	q.deadLetter.Printf("Could not %s CT entry (listener %s, %d attempts, %s: %v): %s", strings.ToLower(del.operation()), del.l.name, del.attempt+1, reason, err, del.entry)
+}
+
+// close closes the dead-letter log
+func (q *retryQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closeDeadLetter()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	conntrack "github.com/florianl/go-conntrack"
+)
+
+func TestRetryQueueFlushDeadline(t *testing.T) {
+	var buf bytes.Buffer
+	q := newRetryQueue()
+	if err := q.configure(log.New(&buf, "", 0), retryConfig{}, ""); err != nil {
+		t.Fatalf("configure() failed: %v", err)
+	}
+	l := &listener{name: "l1"}
+	for _, entry := range []string{"first", "second"} {
+		if !q.schedule(&deletion{l: l, entry: entry}) {
+			t.Fatalf("schedule() rejected %s", entry)
+		}
+	}
+	// retries which cannot be attempted before the deadline go to the dead-letter log
+	if q.flush(time.Now().Add(-time.Second)) {
+		t.Errorf("flush() = true after the deadline")
+	}
+	if got := strings.Count(buf.String(), "drain_timeout"); got != 2 {
+		t.Errorf("dead-letter log has %d drain timeouts, want 2:\n%s", got, buf.String())
+	}
+	if len(q.items) != 0 {
+		t.Errorf("flush() left %d queued retries", len(q.items))
+	}
+}
+
+func TestRetryQueueDrop(t *testing.T) {
+	var buf bytes.Buffer
+	q := newRetryQueue()
+	if err := q.configure(log.New(&buf, "", 0), retryConfig{}, ""); err != nil {
+		t.Fatalf("configure() failed: %v", err)
+	}
+	closed, open := &conntrack.Nfct{}, &conntrack.Nfct{}
+	q.schedule(&deletion{l: &listener{name: "old", nfct: closed}, entry: "first"})
+	q.schedule(&deletion{l: &listener{name: "kept", nfct: open}, entry: "second"})
+	// only the retries using the closed conntrack socket are dropped
+	q.drop(closed, errors.New("closed"))
+	if len(q.items) != 1 || q.items[0].l.name != "kept" {
+		t.Errorf("drop() left %d queued retries, want the one of the open socket", len(q.items))
+	}
+	if !strings.Contains(buf.String(), "namespace_closed") || !strings.Contains(buf.String(), "first") {
+		t.Errorf("dead-letter log = %q, want the dropped retry", buf.String())
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	conntrack "github.com/florianl/go-conntrack"
+	nflog "github.com/florianl/go-nflog/v2"
+)
+
+const (
+	actionDelete = "delete"
+	actionLog    = "log"
+	actionIgnore = "ignore"
+	actionUpdate = "update"
+)
+
+var builtinActions = map[string]*action{
+	actionDelete: {name: actionDelete, kind: actionDelete},
+	actionLog:    {name: actionLog, kind: actionLog},
+	actionIgnore: {name: actionIgnore, kind: actionIgnore},
+}
+
+type action struct {
+	name    string
+	kind    string
+	dryRun  bool
+	update  *ctUpdate
+	scope   *scope
+	cascade *cascade
+}
+
+// verbs returns the verb and the present participle of the action for log messages
+func (a *action) verbs() (string, string) {
+	if a.kind == actionUpdate {
+		return "update", "updating"
+	}
+	return "delete", "deleting"
+}
+
+// modifies reports whether the action deletes or updates conntrack entries
+func (a *action) modifies() bool {
+	return a.kind == actionDelete || a.kind == actionUpdate
+}
+
+type rule struct {
+	name   string
+	match  matcher
+	action *action
+	limit  *tokenBucket
+	dedup  bool
+
+	// conditions checked on the live conntrack entry before deleting it
+	conditions []condition
+}
+
+// packet holds everything known about a received NFLOG message that rules can match on
+type packet struct {
+	attr   nflog.Attribute
+	family conntrack.Family
+	con    conntrack.Con
+	iif    string
+	oif    string
+	vlans  []uint16
+}
+
+type matcher func(p *packet) bool
+
+// matchAll returns a matcher which matches if all of the given matchers match
+func matchAll(matchers ...matcher) matcher {
+	return func(p *packet) bool {
+		for _, m := range matchers {
+			if !m(p) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+var protocolNumbers = map[string]uint8{
+	"icmp":    1,
+	"igmp":    2,
+	"ipip":    4,
+	"tcp":     6,
+	"udp":     17,
+	"ipv6":    41,
+	"gre":     47,
+	"esp":     50,
+	"ah":      51,
+	"icmpv6":  58,
+	"ospf":    89,
+	"pim":     103,
+	"vrrp":    112,
+	"sctp":    132,
+	"dccp":    33,
+	"udplite": 136,
+}
+
+func protocolName(number uint8) string {
+	for name, n := range protocolNumbers {
+		if n == number {
+			return name
+		}
+	}
+	return strconv.Itoa(int(number))
+}
+
+func parseProtocol(s string) (uint8, error) {
+	if number, ok := protocolNumbers[strings.ToLower(s)]; ok {
+		return number, nil
+	}
+	number, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("unknown protocol %q", s)
+	}
+	return uint8(number), nil
+}
+
+func parseFamily(s string) (conntrack.Family, error) {
+	switch strings.ToLower(s) {
+	case "inet", "ipv4", "ip":
+		return conntrack.IPv4, nil
+	case "inet6", "ipv6", "ip6":
+		return conntrack.IPv6, nil
+	}
+	return 0, fmt.Errorf("unknown family %q", s)
+}
+
+// parseNet parses a CIDR or a single IP address
+func parseNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", s)
+		}
+		return ipNet, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+type portRange struct {
+	from, to uint16
+}
+
+func (r portRange) contains(port uint16) bool {
+	return port >= r.from && port <= r.to
+}
+
+// parsePortRange parses a single port or a range of the form FROM-TO
+func parsePortRange(s string) (portRange, error) {
+	from, to, isRange := strings.Cut(s, "-")
+	start, err := strconv.ParseUint(from, 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port %q", from)
+	}
+	r := portRange{from: uint16(start), to: uint16(start)}
+	if isRange {
+		end, err := strconv.ParseUint(to, 10, 16)
+		if err != nil {
+			return portRange{}, fmt.Errorf("invalid port %q", to)
+		}
+		if end < start {
+			return portRange{}, fmt.Errorf("invalid port range %q", s)
+		}
+		r.to = uint16(end)
+	}
+	return r, nil
+}
+
+type markMask struct {
+	value, mask uint32
+}
+
+func (m markMask) matches(mark uint32) bool {
+	return mark&m.mask == m.value&m.mask
+}
+
+// parseMarkMask parses a mark of the form VALUE[/MASK]
+func parseMarkMask(s string) (markMask, error) {
+	value, mask, hasMask := strings.Cut(s, "/")
+	v, err := strconv.ParseUint(value, 0, 32)
+	if err != nil {
+		return markMask{}, fmt.Errorf("invalid mark %q", value)
+	}
+	m := markMask{value: uint32(v), mask: ^uint32(0)}
+	if hasMask {
+		mv, err := strconv.ParseUint(mask, 0, 32)
+		if err != nil {
+			return markMask{}, fmt.Errorf("invalid mask %q", mask)
+		}
+		m.mask = uint32(mv)
+	}
+	return m, nil
+}
+
+func originProto(con conntrack.Con) *conntrack.ProtoTuple {
+	if con.Origin == nil {
+		return nil
+	}
+	return con.Origin.Proto
+}
+
+func matchFamily(family conntrack.Family) matcher {
+	return func(p *packet) bool {
+		return p.family == family
+	}
+}
+
+func matchProtocols(numbers []uint8) matcher {
+	return func(p *packet) bool {
+		proto := originProto(p.con)
+		if proto == nil || proto.Number == nil {
+			return false
+		}
+		for _, number := range numbers {
+			if *proto.Number == number {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func matchNets(nets []*net.IPNet, dst bool) matcher {
+	return func(p *packet) bool {
+		if p.con.Origin == nil {
+			return false
+		}
+		ip := p.con.Origin.Src
+		if dst {
+			ip = p.con.Origin.Dst
+		}
+		if ip == nil {
+			return false
+		}
+		for _, n := range nets {
+			if n.Contains(*ip) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func matchPorts(ranges []portRange, dst bool) matcher {
+	return func(p *packet) bool {
+		proto := originProto(p.con)
+		if proto == nil {
+			return false
+		}
+		port := proto.SrcPort
+		if dst {
+			port = proto.DstPort
+		}
+		if port == nil {
+			return false
+		}
+		for _, r := range ranges {
+			if r.contains(*port) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func matchMark(m markMask) matcher {
+	return func(p *packet) bool {
+		return p.attr.Mark != nil && m.matches(*p.attr.Mark)
+	}
+}
+
+func matchCtMark(m markMask) matcher {
+	return func(p *packet) bool {
+		return p.con.Mark != nil && m.matches(*p.con.Mark)
+	}
+}
+
+func matchPrefix(prefix string) matcher {
+	return func(p *packet) bool {
+		return p.attr.Prefix != nil && *p.attr.Prefix == prefix
+	}
+}
+
+func matchInterface(name string, out bool) matcher {
+	return func(p *packet) bool {
+		if out {
+			return p.oif == name
+		}
+		return p.iif == name
+	}
+}
+
+// matchVLAN returns a matcher which matches packets with a VLAN tag of the given ID
+func matchVLAN(id uint16) matcher {
+	return func(p *packet) bool {
+		return slices.Contains(p.vlans, id)
+	}
+}
+
+// tuples returns the original and the reply tuple of a connection, if present
+func tuples(con conntrack.Con) []*conntrack.IPTuple {
+	var t []*conntrack.IPTuple
+	if con.Origin != nil {
+		t = append(t, con.Origin)
+	}
+	if con.Reply != nil {
+		t = append(t, con.Reply)
+	}
+	return t
+}
+
+// matchAnyAddress matches if any address of the original or reply tuple is in the network
+func matchAnyAddress(n *net.IPNet) matcher {
+	return func(p *packet) bool {
+		for _, t := range tuples(p.con) {
+			if (t.Src != nil && n.Contains(*t.Src)) || (t.Dst != nil && n.Contains(*t.Dst)) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// matchAnyPort matches if any port of the original or reply tuple is in the range
+func matchAnyPort(r portRange) matcher {
+	return func(p *packet) bool {
+		for _, t := range tuples(p.con) {
+			if t.Proto == nil {
+				continue
+			}
+			if (t.Proto.SrcPort != nil && r.contains(*t.Proto.SrcPort)) || (t.Proto.DstPort != nil && r.contains(*t.Proto.DstPort)) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func matchZone(zone uint16) matcher {
+	return func(p *packet) bool {
+		z, ok := packetZone(p)
+		return ok && z == uint64(zone)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net"
+	"slices"
+
+	conntrack "github.com/florianl/go-conntrack"
+)
+
+// scopes widen an action from the conntrack entry of the packet to all entries with the same addresses
+const (
+	scopeFlow      = "flow"
+	scopeSrc       = "src"
+	scopeDst       = "dst"
+	scopePair      = "pair"
+	scopePairProto = "pair_proto"
+)
+
+const defaultScopeMaxEntries = 1000
+
+// scope selects the conntrack entries affected by an action with a wildcard scope
+type scope struct {
+	name string
+	// bothDirections also selects the entries whose reply tuple matches
+	bothDirections bool
+	// allZones selects entries in all zones instead of the zones of the packet
+	allZones bool
+	// maxEntries is the maximum number of entries affected per packet
+	maxEntries int
+}
+
+// matches reports whether a tuple of an entry matches the reference tuple within the scope
+func (s *scope) matches(t, ref *conntrack.IPTuple) bool {
+	if t == nil || t.Src == nil || t.Dst == nil {
+		return false
+	}
+	equal := func(a, b *net.IP) bool { return b != nil && a.Equal(*b) }
+	switch s.name {
+	case scopeSrc:
+		return equal(t.Src, ref.Src)
+	case scopeDst:
+		return equal(t.Dst, ref.Dst)
+	case scopePair:
+		return equal(t.Src, ref.Src) && equal(t.Dst, ref.Dst)
+	case scopePairProto:
+		return equal(t.Src, ref.Src) && equal(t.Dst, ref.Dst) && t.Proto != nil && t.Proto.Number != nil &&
+			ref.Proto != nil && ref.Proto.Number != nil && *t.Proto.Number == *ref.Proto.Number
+	}
+	return false
+}
+
+// entries returns the conntrack entries within the scope of a connection in the given zones, or in all zones
+func (s *scope) entries(nfct *conntrack.Nfct, family conntrack.Family, con conntrack.Con, zones []uint16) ([]conntrack.Con, error) {
+	dump, err := nfct.Dump(conntrack.Conntrack, family)
+	if err != nil {
+		return nil, fmt.Errorf("could not dump conntrack table: %v", err)
+	}
+	var entries []conntrack.Con
+	for _, entry := range dump {
+		var zone uint16
+		if entry.Zone != nil {
+			zone = *entry.Zone
+		}
+		if !s.allZones && !slices.Contains(zones, zone) {
+			continue
+		}
+		if s.matches(entry.Origin, con.Origin) || s.bothDirections && s.matches(entry.Reply, con.Origin) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// scopedDeletion returns the attributes identifying an entry of a wildcard scope, the ID avoids deleting a newer
+// connection which reused the tuple since the dump
+func scopedDeletion(entry conntrack.Con) conntrack.Con {
+	return conntrack.Con{Origin: entry.Origin, ID: entry.ID, Zone: entry.Zone}
+}
+
+// buildScope returns the wildcard scope of an action or nil for the entry of the packet only
+func (ac *actionConfig) buildScope(v *validator, path []any) *scope {
+	if ac.MaxEntries < 0 {
+		v.errorf(field(path, "max_entries"), "negative number of entries")
+	}
+	switch ac.Scope {
+	case "", scopeFlow:
+		if ac.BothDirections || ac.AllZones || ac.MaxEntries != 0 {
+			v.errorf(field(path, "scope"), "both_directions, all_zones and max_entries need a wildcard scope")
+		}
+		return nil
+	case scopeSrc, scopeDst, scopePair, scopePairProto:
+		return &scope{name: ac.Scope, bothDirections: ac.BothDirections, allZones: ac.AllZones, maxEntries: cmp.Or(ac.MaxEntries, defaultScopeMaxEntries)}
+	}
+	v.errorf(field(path, "scope"), "unknown scope %q", ac.Scope)
+	return nil
+}
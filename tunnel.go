@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"slices"
+
+	conntrack "github.com/florianl/go-conntrack"
+	nflog "github.com/florianl/go-nflog/v2"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/sys/unix"
+)
+
+// tunnel protocols which are decapsulated
+const (
+	tunnelGRE    = "gre"
+	tunnelVXLAN  = "vxlan"
+	tunnelGeneve = "geneve"
+	tunnelIPIP   = "ipip"
+	tunnel6in4   = "6in4"
+)
+
+var tunnelProtocols = []string{tunnelGRE, tunnelVXLAN, tunnelGeneve, tunnelIPIP, tunnel6in4}
+
+const (
+	vxlanPort  = 4789
+	genevePort = 6081
+
+	// ethPTEB is the protocol type of Ethernet frames in GRE and Geneve
+	ethPTEB = 0x6558
+)
+
+type tunnelConfig struct {
+	Protocols []string          `yaml:"protocols"`
+	Delete    string            `yaml:"delete"`
+	NetNS     string            `yaml:"netns"`
+	Zones     map[uint32]uint16 `yaml:"zones"`
+}
+
+// tunnelDecap decapsulates tunnel packets to delete the conntrack entries of the inner flows, which may live in
+// another network namespace and in the zone of the tunnel key or VNI
+type tunnelDecap struct {
+	protocols map[string]bool
+	outer     bool
+	inner     bool
+	netns     string
+	zones     map[uint32]uint16
+
+	logger *log.Logger
+	nfct   *conntrack.Nfct
+}
+
+// tunnelPacket is the inner packet of a tunnel packet
+type tunnelPacket struct {
+	protocol string
+	// id is the GRE key or the VNI
+	id        *uint32
+	ethertype uint16
+	// l2hdr is the Ethernet header of VXLAN, Geneve and GRE packets carrying Ethernet frames
+	l2hdr []byte
+	data  []byte
+}
+
+func (tc *tunnelConfig) build(v *validator, path []any) *tunnelDecap {
+	if tc == nil {
+		return nil
+	}
+	t := &tunnelDecap{protocols: make(map[string]bool), netns: tc.NetNS, zones: tc.Zones}
+	for i, name := range tc.Protocols {
+		if !slices.Contains(tunnelProtocols, name) {
+			v.errorf(field(path, "protocols", i), "unknown tunnel protocol %q", name)
+		}
+		t.protocols[name] = true
+	}
+	if len(tc.Protocols) == 0 {
+		for _, name := range tunnelProtocols {
+			t.protocols[name] = true
+		}
+	}
+	switch tc.Delete {
+	case "", "inner":
+		t.inner = true
+	case "outer":
+		t.outer = true
+	case "both":
+		t.inner, t.outer = true, true
+	default:
+		v.errorf(field(path, "delete"), "unknown tunnel deletion %q", tc.Delete)
+	}
+	if t.netns != "" {
+		validateNetNS(v, field(path, "netns"), t.netns)
+	}
+	return t
+}
+
+// decapsulate returns the inner packet of an IP packet of one of the decapsulated tunnel protocols, fragmented tunnel
+// packets are not decapsulated
+func (t *tunnelDecap) decapsulate(data []byte) (*tunnelPacket, bool) {
+	var pkt gopacket.Packet
+	switch {
+	case len(data) > 0 && data[0]>>4 == 4:
+		pkt = gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.NoCopy)
+	case len(data) > 0 && data[0]>>4 == 6:
+		pkt = gopacket.NewPacket(data, layers.LayerTypeIPv6, gopacket.NoCopy)
+	default:
+		return nil, false
+	}
+	proto, l4, frag := transportPayload(pkt)
+	if frag != nil {
+		return nil, false
+	}
+	var tp *tunnelPacket
+	switch proto {
+	case 4:
+		tp = &tunnelPacket{protocol: tunnelIPIP, ethertype: unix.ETH_P_IP, data: l4}
+	case 41:
+		tp = &tunnelPacket{protocol: tunnel6in4, ethertype: unix.ETH_P_IPV6, data: l4}
+	case 47:
+		tp = decapsulateGRE(l4)
+	case 17:
+		if len(l4) < 8 {
+			return nil, false
+		}
+		switch binary.BigEndian.Uint16(l4[2:4]) {
+		case vxlanPort:
+			tp = decapsulateVXLAN(l4[8:])
+		case genevePort:
+			tp = decapsulateGeneve(l4[8:])
+		}
+	}
+	if tp == nil || !t.protocols[tp.protocol] {
+		return nil, false
+	}
+	return tp, true
+}
+
+// decapsulateGRE returns the inner packet of a GRE header, the enhanced GRE header of PPTP is not a tunnel
+func decapsulateGRE(gre []byte) *tunnelPacket {
+	if len(gre) < 4 || gre[1]&0x07 != 0 {
+		return nil
+	}
+	hlen := 4
+	if gre[0]&0x80 != 0 { // checksum
+		hlen += 4
+	}
+	var id *uint32
+	if gre[0]&0x20 != 0 { // key
+		if len(gre) < hlen+4 {
+			return nil
+		}
+		key := binary.BigEndian.Uint32(gre[hlen : hlen+4])
+		id = &key
+		hlen += 4
+	}
+	if gre[0]&0x10 != 0 { // sequence number
+		hlen += 4
+	}
+	if len(gre) < hlen {
+		return nil
+	}
+	return innerPacket(tunnelGRE, id, binary.BigEndian.Uint16(gre[2:4]), gre[hlen:])
+}
+
+// decapsulateVXLAN returns the Ethernet frame of a VXLAN header
+func decapsulateVXLAN(vxlan []byte) *tunnelPacket {
+	if len(vxlan) < 8 || vxlan[0]&0x08 == 0 {
+		return nil
+	}
+	vni := binary.BigEndian.Uint32(vxlan[4:8]) >> 8
+	return innerPacket(tunnelVXLAN, &vni, ethPTEB, vxlan[8:])
+}
+
+// decapsulateGeneve returns the inner packet of a Geneve header
+func decapsulateGeneve(geneve []byte) *tunnelPacket {
+	if len(geneve) < 8 || geneve[0]>>6 != 0 {
+		return nil
+	}
+	hlen := 8 + int(geneve[0]&0x3f)*4
+	if len(geneve) < hlen {
+		return nil
+	}
+	vni := binary.BigEndian.Uint32(geneve[4:8]) >> 8
+	return innerPacket(tunnelGeneve, &vni, binary.BigEndian.Uint16(geneve[2:4]), geneve[hlen:])
+}
+
+func innerPacket(protocol string, id *uint32, ethertype uint16, data []byte) *tunnelPacket {
+	if ethertype != ethPTEB {
+		return &tunnelPacket{protocol: protocol, id: id, ethertype: ethertype, data: data}
+	}
+	if len(data) < ethHeaderLen {
+		return nil
+	}
+	return &tunnelPacket{protocol: protocol, id: id, l2hdr: data[:ethHeaderLen], data: data[ethHeaderLen:]}
+}
+
+// attribute returns the NFLOG message of the inner packet, which carries no conntrack information
+func (tp *tunnelPacket) attribute(m nflog.Attribute) nflog.Attribute {
+	inner := m
+	inner.Ct, inner.CtInfo, inner.VLAN = nil, nil, nil
+	inner.Payload = &tp.data
+	if tp.l2hdr != nil {
+		inner.Layer2Hdr, inner.HwProtocol = &tp.l2hdr, nil
+	} else {
+		inner.Layer2Hdr, inner.HwProtocol = nil, &tp.ethertype
+	}
+	return inner
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	conntrack "github.com/florianl/go-conntrack"
+	"golang.org/x/sys/unix"
+)
+
+// status bits which can be set on an existing conntrack entry
+var updatableStatus = []string{"seen_reply", "assured"}
+
+// ctUpdate are the attributes an update action changes on a conntrack entry
+type ctUpdate struct {
+	mark    *markMask
+	timeout *uint32
+	status  uint32
+}
+
+// buildUpdate returns the attributes changed by an update action
+func (ac *actionConfig) buildUpdate(v *validator, path []any) *ctUpdate {
+	u := &ctUpdate{}
+	if ac.Mark != "" {
+		m, err := parseMarkMask(ac.Mark)
+		if err != nil {
+			v.errorf(field(path, "mark"), "%v", err)
+		}
+		u.mark = &m
+	}
+	if ac.Timeout != nil {
+		if *ac.Timeout < time.Second {
+			v.errorf(field(path, "timeout"), "timeout below 1s")
+		}
+		timeout := uint32(ac.Timeout.Seconds())
+		u.timeout = &timeout
+	}
+	for i, name := range ac.Status {
+		if !slices.Contains(updatableStatus, name) {
+			v.errorf(field(path, "status", i), "status %q can not be set, only %s", name, strings.Join(updatableStatus, " and "))
+			continue
+		}
+		u.status |= statusBits[name]
+	}
+	if u.mark == nil && u.timeout == nil && u.status == 0 {
+		v.errorf(path, "update action without mark, timeout or status")
+	}
+	return u
+}
+
+// apply updates a conntrack entry, status bits are added to the current status of the entry. The kernel ignores the
+// ID of an update, so an entry with ID is only updated if the live entry still has it.
+func (u *ctUpdate) apply(nfct *conntrack.Nfct, logger *log.Logger, family conntrack.Family, con conntrack.Con) error {
+	attrs := conntrack.Con{Origin: con.Origin, Reply: con.Reply, Zone: con.Zone, Timeout: u.timeout}
+	if u.mark != nil {
+		mark := u.mark.value & u.mark.mask
+		attrs.Mark, attrs.MarkMask = &mark, &u.mark.mask
+	}
+	if u.status != 0 || con.ID != nil {
+		entry, err := getConntrack(nfct, logger, family, con)
+		if err != nil {
+			return err
+		}
+		if con.ID != nil && (entry.ID == nil || *entry.ID != *con.ID) {
+			return unix.ENOENT
+		}
+		if u.status != 0 {
+			if entry.Status == nil {
+				return fmt.Errorf("conntrack entry without status")
+			}
+			status := *entry.Status | u.status
+			attrs.Status = &status
+		}
+	}
+	return updateConntrack(nfct, family, attrs)
+}
+
+// String describes the changed attributes
+func (u *ctUpdate) String() string {
+	var changes []string
+	if u.mark != nil {
+		changes = append(changes, fmt.Sprintf("ctmark 0x%x/0x%x", u.mark.value, u.mark.mask))
+	}
+	if u.timeout != nil {
+		changes = append(changes, fmt.Sprintf("timeout %ds", *u.timeout))
+	}
+	for _, name := range updatableStatus {
+		if u.status&statusBits[name] != 0 {
+			changes = append(changes, "status "+name)
+		}
+	}
+	return strings.Join(changes, ", ")
+}